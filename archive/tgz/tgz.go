@@ -0,0 +1,61 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package tgz
+
+import (
+	"io"
+	"runtime"
+
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/archive/tar"
+	"github.com/klauspost/pgzip"
+)
+
+// blockSize is the size of the blocks compressed in parallel.
+const blockSize = 1 << 20
+
+type tgzArchive struct {
+	level   int
+	threads int
+}
+
+// New creates an archive that uses the .tar.gz file format. The level uses
+// the gzip scale from 0 to 9, a level of -1 uses the default compression.
+// Blocks are compressed in parallel using the number of threads, 0 uses all
+// cores. The output is a standard gzip stream.
+func New(level, threads int) archive.Archive {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	return &tgzArchive{level: level, threads: threads}
+}
+
+func (a *tgzArchive) Pack(srcs []string, w io.Writer) error {
+	gw, err := pgzip.NewWriterLevel(w, a.level)
+	if err != nil {
+		return err
+	}
+	if err := gw.SetConcurrency(blockSize, a.threads); err != nil {
+		return err
+	}
+
+	if err := tar.New().Pack(srcs, gw); err != nil {
+		gw.Close()
+		return err
+	}
+
+	return gw.Close()
+}
+
+func (a *tgzArchive) Unpack(dst string, r io.Reader) error {
+	gr, err := pgzip.NewReaderN(r, blockSize, a.threads)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	return tar.New().Unpack(dst, gr)
+}
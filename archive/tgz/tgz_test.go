@@ -0,0 +1,52 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package tgz
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/drone/drone-cache-lib/archive/tgz"
+)
+
+func TestPackUnpack(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "test.txt"), bytes.Repeat([]byte("hello\ngo\n"), 1<<18), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := New(9, 4).Pack([]string{src}, &b); err != nil {
+		t.Fatal(err)
+	}
+
+	// The parallel output must be readable by a standard decoder
+	dst := t.TempDir()
+	if err := tgz.New().Unpack(dst, bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, filepath.Join(dst, src, "test.txt"))
+
+	dst = t.TempDir()
+	if err := New(-1, 0).Unpack(dst, &b); err != nil {
+		t.Fatal(err)
+	}
+	checkContent(t, filepath.Join(dst, src, "test.txt"))
+}
+
+func checkContent(t *testing.T, file string) {
+	t.Helper()
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, bytes.Repeat([]byte("hello\ngo\n"), 1<<18)) {
+		t.Errorf("unexpected content in %s", file)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Level is a compression level. Positive values use the scale of the archive
+// format, 1-9 for gzip and 1-22 for zstd.
+type Level int
+
+// Named compression levels that apply to every format.
+const (
+	DefaultLevel  Level = 0
+	NoCompression Level = -1
+	FastestLevel  Level = -2
+	BestLevel     Level = -3
+)
+
+// ParseLevel parses a compression level which is either default, none,
+// fastest, best or a number.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "default":
+		return DefaultLevel, nil
+	case "none":
+		return NoCompression, nil
+	case "fastest":
+		return FastestLevel, nil
+	case "best":
+		return BestLevel, nil
+	}
+
+	level, err := strconv.Atoi(s)
+	if err != nil || level < 0 {
+		return DefaultLevel, fmt.Errorf("invalid compression level %s", s)
+	}
+	if level == 0 {
+		return NoCompression, nil
+	}
+	return Level(level), nil
+}
+
+func (l Level) String() string {
+	switch l {
+	case DefaultLevel:
+		return "default"
+	case NoCompression:
+		return "none"
+	case FastestLevel:
+		return "fastest"
+	case BestLevel:
+		return "best"
+	}
+	return strconv.Itoa(int(l))
+}
+
+// gzipLevel maps the level to the gzip scale.
+func (l Level) gzipLevel() (int, error) {
+	switch l {
+	case DefaultLevel:
+		return -1, nil
+	case NoCompression:
+		return 0, nil
+	case FastestLevel:
+		return 1, nil
+	case BestLevel:
+		return 9, nil
+	}
+	if l > 9 {
+		return 0, fmt.Errorf("compression level %d out of range 1-9 for gzip", l)
+	}
+	return int(l), nil
+}
+
+// zstdLevel maps the level to the zstd scale. Zstd always compresses so no
+// compression uses the fastest level.
+func (l Level) zstdLevel() (int, error) {
+	switch l {
+	case DefaultLevel:
+		return 0, nil
+	case NoCompression, FastestLevel:
+		return 1, nil
+	case BestLevel:
+		return 22, nil
+	}
+	if l > 22 {
+		return 0, fmt.Errorf("compression level %d out of range 1-22 for zstd", l)
+	}
+	return int(l), nil
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/drone-plugins/drone-s3-cache/archive/tgz"
+	"github.com/drone-plugins/drone-s3-cache/archive/zstd"
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/archive/tar"
+)
+
+// Options contains configuration for the archive formats.
+type Options struct {
+	// Level is the compression level, it is ignored by uncompressed formats.
+	Level Level
+
+	// Threads is the number of threads used to compress and decompress, 0
+	// uses all cores.
+	Threads int
+}
+
+type format struct {
+	extensions []string
+	// contentTypes are the content types of the format, archives are
+	// uploaded with the first.
+	contentTypes []string
+	archive      func(opts Options) (archive.Archive, error)
+}
+
+var formats = []format{
+	{
+		extensions:   []string{".tar.zst", ".tzst"},
+		contentTypes: []string{"application/zstd"},
+		archive: func(opts Options) (archive.Archive, error) {
+			level, err := opts.Level.zstdLevel()
+			if err != nil {
+				return nil, err
+			}
+			return zstd.New(level, opts.Threads), nil
+		},
+	},
+	{
+		extensions:   []string{".tar.gz", ".tgz"},
+		contentTypes: []string{"application/gzip"},
+		archive: func(opts Options) (archive.Archive, error) {
+			level, err := opts.Level.gzipLevel()
+			if err != nil {
+				return nil, err
+			}
+			return tgz.New(level, opts.Threads), nil
+		},
+	},
+	{
+		extensions: []string{".tar"},
+		// Archives uploaded by earlier versions use application/tar
+		contentTypes: []string{"application/x-tar", "application/tar"},
+		archive: func(opts Options) (archive.Archive, error) {
+			return tar.New(), nil
+		},
+	},
+}
+
+// FromFilename determines the archive format to use based on the name.
+func FromFilename(name string, opts Options) (archive.Archive, error) {
+	f, ok := formatFromFilename(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown file format for archive %s", name)
+	}
+	return f.archive(opts)
+}
+
+// FromContentType determines the archive format to use based on the content
+// type of a stored archive.
+func FromContentType(contentType string, opts Options) (archive.Archive, error) {
+	for _, f := range formats {
+		for _, ct := range f.contentTypes {
+			if ct == contentType {
+				return f.archive(opts)
+			}
+		}
+	}
+	return nil, fmt.Errorf("unknown content type %s for archive", contentType)
+}
+
+// ContentType returns the content type for the archive name.
+func ContentType(name string) string {
+	if f, ok := formatFromFilename(name); ok {
+		return f.contentTypes[0]
+	}
+	return "application/octet-stream"
+}
+
+// Alternatives returns the name followed by the name using each of the other
+// archive formats. This allows archives stored before switching formats to
+// still be found. Only the name is returned when it does not have a known
+// extension.
+func Alternatives(name string) []string {
+	f, ok := formatFromFilename(name)
+	if !ok {
+		return []string{name}
+	}
+
+	var stem string
+	for _, ext := range f.extensions {
+		if strings.HasSuffix(name, ext) {
+			stem = strings.TrimSuffix(name, ext)
+			break
+		}
+	}
+
+	names := []string{name}
+	for _, other := range formats {
+		if other.extensions[0] != f.extensions[0] {
+			names = append(names, stem+other.extensions[0])
+		}
+	}
+	return names
+}
+
+func formatFromFilename(name string) (format, bool) {
+	for _, f := range formats {
+		for _, ext := range f.extensions {
+			if strings.HasSuffix(name, ext) {
+				return f, true
+			}
+		}
+	}
+	return format{}, false
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package util
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/drone/drone-cache-lib/archive/tar"
+)
+
+func TestFromFilename(t *testing.T) {
+	for _, name := range []string{"archive.tar", "archive.tgz", "archive.tar.gz", "archive.tar.zst", "archive.tzst"} {
+		if _, err := FromFilename(name, Options{}); err != nil {
+			t.Errorf("unexpected error for %s: %s", name, err)
+		}
+	}
+
+	if _, err := FromFilename("archive.zip", Options{}); err == nil {
+		t.Error("expected error for unknown format")
+	}
+}
+
+func TestLevel(t *testing.T) {
+	tests := map[string]Level{
+		"":        DefaultLevel,
+		"default": DefaultLevel,
+		"none":    NoCompression,
+		"0":       NoCompression,
+		"Fastest": FastestLevel,
+		"best":    BestLevel,
+		"12":      12,
+	}
+	for value, want := range tests {
+		got, err := ParseLevel(value)
+		if err != nil {
+			t.Errorf("unexpected error for %s: %s", value, err)
+		} else if got != want {
+			t.Errorf("ParseLevel(%s) = %s, want %s", value, got, want)
+		}
+	}
+
+	for _, value := range []string{"-1", "max"} {
+		if _, err := ParseLevel(value); err == nil {
+			t.Errorf("expected error for %s", value)
+		}
+	}
+
+	if _, err := FromFilename("archive.tar.gz", Options{Level: 12}); err == nil {
+		t.Error("expected error for gzip level out of range")
+	}
+	if _, err := FromFilename("archive.tar.zst", Options{Level: 12}); err != nil {
+		t.Errorf("unexpected error for zstd level: %s", err)
+	}
+	if _, err := FromFilename("archive.tar", Options{Level: 30}); err != nil {
+		t.Errorf("unexpected error for uncompressed archive: %s", err)
+	}
+}
+
+func TestFromContentType(t *testing.T) {
+	for _, name := range []string{"archive.tar", "archive.tar.gz", "archive.tar.zst"} {
+		if _, err := FromContentType(ContentType(name), Options{}); err != nil {
+			t.Errorf("unexpected error for %s: %s", name, err)
+		}
+	}
+
+	at, err := FromContentType("application/tar", Options{})
+	if err != nil {
+		t.Fatalf("unexpected error for application/tar: %s", err)
+	}
+	if reflect.TypeOf(at) != reflect.TypeOf(tar.New()) {
+		t.Errorf("got %T for application/tar, want a tar archive", at)
+	}
+}
+
+func TestAlternatives(t *testing.T) {
+	tests := map[string][]string{
+		"archive.tar.zst": {"archive.tar.zst", "archive.tar.gz", "archive.tar"},
+		"archive.tgz":     {"archive.tgz", "archive.tar.zst", "archive.tar"},
+		"archive.zip":     {"archive.zip"},
+	}
+
+	for name, want := range tests {
+		if got := Alternatives(name); !reflect.DeepEqual(got, want) {
+			t.Errorf("Alternatives(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
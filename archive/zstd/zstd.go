@@ -0,0 +1,62 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package zstd
+
+import (
+	"io"
+	"runtime"
+
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/archive/tar"
+	"github.com/klauspost/compress/zstd"
+)
+
+type zstdArchive struct {
+	level   int
+	threads int
+}
+
+// New creates an archive that uses the .tar.zst file format. The level uses
+// the zstd scale from 1 to 22, a level of 0 uses the default compression.
+// Compression and decompression use the number of threads, 0 uses all cores.
+func New(level, threads int) archive.Archive {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	return &zstdArchive{level: level, threads: threads}
+}
+
+func (a *zstdArchive) Pack(srcs []string, w io.Writer) error {
+	level := zstd.SpeedDefault
+	if a.level != 0 {
+		level = zstd.EncoderLevelFromZstd(a.level)
+	}
+
+	zw, err := zstd.NewWriter(w,
+		zstd.WithEncoderLevel(level),
+		zstd.WithEncoderConcurrency(a.threads),
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := tar.New().Pack(srcs, zw); err != nil {
+		zw.Close()
+		return err
+	}
+
+	return zw.Close()
+}
+
+func (a *zstdArchive) Unpack(dst string, r io.Reader) error {
+	zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(a.threads))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	return tar.New().Unpack(dst, zr)
+}
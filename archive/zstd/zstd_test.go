@@ -0,0 +1,38 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package zstd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackUnpack(t *testing.T) {
+	src := t.TempDir()
+	if err := os.WriteFile(filepath.Join(src, "test.txt"), []byte("hello\ngo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	if err := New(19, 2).Pack([]string{src}, &b); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := t.TempDir()
+	if err := New(0, 0).Unpack(dst, &b); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dst, src, "test.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello\ngo\n" {
+		t.Errorf("unexpected content %q", data)
+	}
+}
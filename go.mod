@@ -7,16 +7,18 @@ require (
 	github.com/drone/drone-cache-lib v0.0.0-20200806063744-981868645a25
 	github.com/dustin/go-humanize v1.0.0
 	github.com/joho/godotenv v1.4.0
+	github.com/klauspost/compress v1.15.9
+	github.com/klauspost/pgzip v1.2.5
 	github.com/minio/minio-go/v7 v7.0.45
 	github.com/sirupsen/logrus v1.9.0
 	github.com/urfave/cli/v2 v2.23.6
+	golang.org/x/crypto v0.4.0
 )
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
 	github.com/google/uuid v1.3.0 // indirect
 	github.com/json-iterator/go v1.1.12 // indirect
-	github.com/klauspost/compress v1.15.9 // indirect
 	github.com/klauspost/cpuid/v2 v2.1.0 // indirect
 	github.com/minio/md5-simd v1.1.2 // indirect
 	github.com/minio/sha256-simd v1.0.0 // indirect
@@ -25,7 +27,6 @@ require (
 	github.com/rs/xid v1.4.0 // indirect
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
-	golang.org/x/crypto v0.4.0 // indirect
 	golang.org/x/net v0.4.0 // indirect
 	golang.org/x/sys v0.3.0 // indirect
 	golang.org/x/text v0.5.0 // indirect
@@ -9,6 +9,7 @@ package main
 
 import (
 	"os"
+	"time"
 
 	"github.com/drone-plugins/drone-plugin-lib/errors"
 	"github.com/drone-plugins/drone-plugin-lib/urfave"
@@ -42,6 +43,7 @@ func main() {
 func run(settings *plugin.Settings) cli.ActionFunc {
 	return func(ctx *cli.Context) error {
 		urfave.LoggingFromContext(ctx)
+		settings.Version = version
 
 		plugin := plugin.New(
 			*settings,
@@ -82,7 +84,7 @@ func settingsFlags(settings *plugin.Settings) []cli.Flag {
 		},
 		&cli.StringFlag{
 			Name:        "filename",
-			Usage:       "filename for the cache archive",
+			Usage:       "filename for the cache archive (.tar, .tar.gz, .tar.zst), rendered as a template",
 			EnvVars:     []string{"PLUGIN_FILENAME"},
 			Destination: &settings.Filename,
 		},
@@ -94,16 +96,70 @@ func settingsFlags(settings *plugin.Settings) []cli.Flag {
 		},
 		&cli.StringFlag{
 			Name:        "path",
-			Usage:       "path to cache files relative to root",
+			Usage:       "path to cache files relative to root, rendered as a template",
 			EnvVars:     []string{"PLUGIN_PATH"},
 			Destination: &settings.Path,
 		},
 		&cli.StringFlag{
 			Name:        "fallback-path",
-			Usage:       "path to default cache files relative to the root",
+			Usage:       "path to default cache files relative to the root, rendered as a template",
 			EnvVars:     []string{"PLUGIN_FALLBACK_PATH"},
 			Destination: &settings.FallbackPath,
 		},
+		&cli.StringSliceFlag{
+			Name:        "restore-keys",
+			Usage:       "ordered keys to restore from when path misses, rendered as templates",
+			EnvVars:     []string{"PLUGIN_RESTORE_KEYS"},
+			Destination: &settings.RestoreKeys,
+		},
+		&cli.BoolFlag{
+			Name:        "restore-prefix",
+			Usage:       "restore the newest archive under a key when there is no exact match",
+			EnvVars:     []string{"PLUGIN_RESTORE_PREFIX"},
+			Destination: &settings.RestorePrefix,
+		},
+		&cli.BoolFlag{
+			Name:        "immutable",
+			Usage:       "skip rebuilding the cache when the path already exists",
+			EnvVars:     []string{"PLUGIN_IMMUTABLE"},
+			Destination: &settings.Immutable,
+		},
+		&cli.BoolFlag{
+			Name:        "skip-unchanged",
+			Usage:       "skip rebuilding the cache when the mounts are unchanged since restore",
+			EnvVars:     []string{"PLUGIN_SKIP_UNCHANGED"},
+			Destination: &settings.SkipUnchanged,
+		},
+		&cli.BoolFlag{
+			Name:        "archive-per-mount",
+			Usage:       "store each mount in an archive of its own",
+			EnvVars:     []string{"PLUGIN_ARCHIVE_PER_MOUNT"},
+			Destination: &settings.ArchivePerMount,
+		},
+		&cli.StringFlag{
+			Name:        "caches",
+			Usage:       "json list of named caches with a name, path, filename, mount and restore-keys",
+			EnvVars:     []string{"PLUGIN_CACHES"},
+			Destination: &settings.Caches,
+		},
+		&cli.BoolFlag{
+			Name:        "track-access",
+			Usage:       "record when a cache is restored so flush can expire unused caches",
+			EnvVars:     []string{"PLUGIN_TRACK_ACCESS"},
+			Destination: &settings.TrackAccess,
+		},
+		&cli.StringFlag{
+			Name:        "compression-level",
+			Usage:       "compression level for the archive format, either default, none, fastest, best or a number",
+			EnvVars:     []string{"PLUGIN_COMPRESSION_LEVEL"},
+			Destination: &settings.CompressionLevel,
+		},
+		&cli.IntFlag{
+			Name:        "compression-threads",
+			Usage:       "threads used to compress and decompress archives, 0 uses all cores",
+			EnvVars:     []string{"PLUGIN_COMPRESSION_THREADS"},
+			Destination: &settings.CompressionThreads,
+		},
 		&cli.StringFlag{
 			Name:        "flush-path",
 			Usage:       "path to flushable cache files relative to the root",
@@ -123,6 +179,55 @@ func settingsFlags(settings *plugin.Settings) []cli.Flag {
 			Value:       30,
 			Destination: &settings.FlushAge,
 		},
+		&cli.IntFlag{
+			Name:        "flush-unused-age",
+			Usage:       "flush cache files not restored or rebuilt in # days instead of by age",
+			EnvVars:     []string{"PLUGIN_FLUSH_UNUSED_AGE"},
+			Destination: &settings.FlushUnusedAge,
+		},
+		&cli.StringSliceFlag{
+			Name:        "flush-branches",
+			Usage:       "live branches, flush cache files of all other branches",
+			EnvVars:     []string{"PLUGIN_FLUSH_BRANCHES"},
+			Destination: &settings.FlushBranches,
+		},
+		&cli.StringFlag{
+			Name:        "flush-branches-file",
+			Usage:       "file listing live branches, flush cache files of all other branches",
+			EnvVars:     []string{"PLUGIN_FLUSH_BRANCHES_FILE"},
+			Destination: &settings.FlushBranchesFile,
+		},
+		&cli.StringFlag{
+			Name:        "flush-branch-pattern",
+			Usage:       "pattern matching the first path segment of branch caches, required to flush dead branches, other keys such as shared seeds are never flushed",
+			EnvVars:     []string{"PLUGIN_FLUSH_BRANCH_PATTERN"},
+			Destination: &settings.FlushBranchPattern,
+		},
+		&cli.IntFlag{
+			Name:        "flush-keep",
+			Usage:       "flush all but the # newest versions of each cache, archives with the same filename under the same branch are versions",
+			EnvVars:     []string{"PLUGIN_FLUSH_KEEP"},
+			Destination: &settings.FlushKeep,
+		},
+		&cli.IntFlag{
+			Name:        "flush-keep-depth",
+			Usage:       "number of directories under the flush path identifying a cache when keeping the newest versions, such as 2 for branches containing a slash",
+			Value:       1,
+			EnvVars:     []string{"PLUGIN_FLUSH_KEEP_DEPTH"},
+			Destination: &settings.FlushKeepDepth,
+		},
+		&cli.StringFlag{
+			Name:        "flush-max-size",
+			Usage:       "flush the least recently used cache files until the total size fits, e.g. 20GB",
+			EnvVars:     []string{"PLUGIN_FLUSH_MAX_SIZE"},
+			Destination: &settings.FlushMaxSize,
+		},
+		&cli.BoolFlag{
+			Name:        "flush-dry-run",
+			Usage:       "report the cache files that would be flushed without deleting them",
+			EnvVars:     []string{"PLUGIN_FLUSH_DRY_RUN"},
+			Destination: &settings.FlushDryRun,
+		},
 
 		// Cache information (deprecated)
 
@@ -195,5 +300,140 @@ func settingsFlags(settings *plugin.Settings) []cli.Flag {
 			EnvVars:     []string{"PLUGIN_PROFILE", "CACHE_S3_PROFILE", "AWS_PROFILE"},
 			Destination: &settings.S3Options.Profile,
 		},
+		&cli.IntFlag{
+			Name:        "download-concurrency",
+			Usage:       "number of parts of an archive downloaded concurrently",
+			Value:       4,
+			EnvVars:     []string{"PLUGIN_DOWNLOAD_CONCURRENCY"},
+			Destination: &settings.S3Options.DownloadConcurrency,
+		},
+		&cli.StringFlag{
+			Name:        "download-part-size",
+			Usage:       "size of the parts of an archive downloaded concurrently",
+			Value:       "16MiB",
+			EnvVars:     []string{"PLUGIN_DOWNLOAD_PART_SIZE"},
+			Destination: &settings.DownloadPartSize,
+		},
+		&cli.IntFlag{
+			Name:        "upload-concurrency",
+			Usage:       "number of parts of an archive uploaded concurrently when spooled",
+			Value:       4,
+			EnvVars:     []string{"PLUGIN_UPLOAD_CONCURRENCY"},
+			Destination: &settings.S3Options.UploadConcurrency,
+		},
+		&cli.StringFlag{
+			Name:        "upload-part-size",
+			Usage:       "size of the parts an archive is uploaded in, only a part is buffered in memory",
+			Value:       "16MiB",
+			EnvVars:     []string{"PLUGIN_UPLOAD_PART_SIZE"},
+			Destination: &settings.UploadPartSize,
+		},
+		&cli.BoolFlag{
+			Name:        "upload-spool",
+			Usage:       "write archives to a temporary file before uploading so parts can be uploaded concurrently",
+			EnvVars:     []string{"PLUGIN_UPLOAD_SPOOL"},
+			Destination: &settings.S3Options.UploadSpool,
+		},
+		&cli.IntFlag{
+			Name:        "retries",
+			Usage:       "number of times a failed request is retried, transfers resume from the last part received",
+			Value:       3,
+			EnvVars:     []string{"PLUGIN_RETRIES"},
+			Destination: &settings.S3Options.Retries,
+		},
+		&cli.StringFlag{
+			Name:        "encryption",
+			Usage:       "server side encryption of archives, either sse-s3, sse-kms or sse-c",
+			EnvVars:     []string{"PLUGIN_ENCRYPTION"},
+			Destination: &settings.S3Options.Encryption,
+		},
+		&cli.StringFlag{
+			Name:        "kms-key-id",
+			Usage:       "kms key used with sse-kms encryption, the bucket key is used when empty",
+			EnvVars:     []string{"PLUGIN_KMS_KEY_ID"},
+			Destination: &settings.S3Options.KMSKeyID,
+		},
+		&cli.StringFlag{
+			Name:        "kms-context",
+			Usage:       "encryption context used with sse-kms encryption as a JSON object",
+			EnvVars:     []string{"PLUGIN_KMS_CONTEXT"},
+			Destination: &settings.KMSContext,
+		},
+		&cli.StringFlag{
+			Name:        "customer-key",
+			Usage:       "base64 encoded 256 bit key used with sse-c encryption",
+			EnvVars:     []string{"PLUGIN_CUSTOMER_KEY"},
+			Destination: &settings.CustomerKey,
+		},
+		&cli.BoolFlag{
+			Name:        "checksum",
+			Usage:       "record the sha256 of archives and verify it on restore, archives are written to a temporary file on rebuild and restore which needs disk space for the whole archive",
+			Value:       true,
+			EnvVars:     []string{"PLUGIN_CHECKSUM"},
+			Destination: &settings.S3Options.Checksum,
+		},
+		&cli.StringFlag{
+			Name:        "storage-class",
+			Usage:       "storage class of uploaded archives such as STANDARD_IA or REDUCED_REDUNDANCY",
+			EnvVars:     []string{"PLUGIN_STORAGE_CLASS"},
+			Destination: &settings.S3Options.StorageClass,
+		},
+		&cli.StringFlag{
+			Name:        "tags",
+			Usage:       "tags added to uploaded archives as a JSON object",
+			EnvVars:     []string{"PLUGIN_TAGS"},
+			Destination: &settings.Tags,
+		},
+		&cli.StringFlag{
+			Name:        "metadata",
+			Usage:       "metadata added to uploaded archives as a JSON object, the repo, branch, commit, build number and plugin version are recorded by default",
+			EnvVars:     []string{"PLUGIN_METADATA"},
+			Destination: &settings.Metadata,
+		},
+		&cli.StringFlag{
+			Name:        "signing-key",
+			Usage:       "base64 encoded ed25519 private key used to sign archives on rebuild",
+			EnvVars:     []string{"PLUGIN_SIGNING_KEY"},
+			Destination: &settings.SigningKey,
+		},
+		&cli.StringFlag{
+			Name:        "verify-key",
+			Usage:       "base64 encoded ed25519 public key, only archives signed with the matching private key are restored",
+			EnvVars:     []string{"PLUGIN_VERIFY_KEY"},
+			Destination: &settings.VerifyKey,
+		},
+		&cli.StringFlag{
+			Name:        "client-encryption-key",
+			Usage:       "secret used to encrypt archives before they are uploaded",
+			EnvVars:     []string{"PLUGIN_CLIENT_ENCRYPTION_KEY"},
+			Destination: &settings.ClientEncryptionKey,
+		},
+		&cli.DurationFlag{
+			Name:        "connect-timeout",
+			Usage:       "time allowed to connect to s3",
+			Value:       10 * time.Second,
+			EnvVars:     []string{"PLUGIN_CONNECT_TIMEOUT"},
+			Destination: &settings.S3Options.ConnectTimeout,
+		},
+		&cli.DurationFlag{
+			Name:        "request-timeout",
+			Usage:       "time allowed for requests that do not transfer an archive such as stat and delete, and for each page when listing",
+			Value:       30 * time.Second,
+			EnvVars:     []string{"PLUGIN_REQUEST_TIMEOUT"},
+			Destination: &settings.S3Options.RequestTimeout,
+		},
+		&cli.DurationFlag{
+			Name:        "idle-timeout",
+			Usage:       "time a transfer can go without sending or receiving data before it is retried",
+			Value:       time.Minute,
+			EnvVars:     []string{"PLUGIN_IDLE_TIMEOUT"},
+			Destination: &settings.S3Options.IdleTimeout,
+		},
+		&cli.DurationFlag{
+			Name:        "total-timeout",
+			Usage:       "time allowed to transfer an archive including retries, 0 for no limit",
+			EnvVars:     []string{"PLUGIN_TOTAL_TIMEOUT"},
+			Destination: &settings.S3Options.TotalTimeout,
+		},
 	}
 }
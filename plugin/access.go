@@ -0,0 +1,76 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"strings"
+	"time"
+
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// accessSuffix is appended to the path of an archive to get the path of the
+// sidecar object recording when the archive was last restored. The last
+// modified time of the sidecar is the last access time.
+const accessSuffix = ".last-access"
+
+// cacheEntry is an archive found when flushing along with when it was last
+// used.
+type cacheEntry struct {
+	storage.FileEntry
+
+	// LastAccess is the last time the archive was restored or written.
+	LastAccess time.Time
+
+	// sidecar is the path of the last access sidecar if one exists.
+	sidecar string
+}
+
+// recordAccess writes the sidecar for the archive at path.
+func recordAccess(st storage.Storage, path string) {
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err := st.Put(path+accessSuffix, strings.NewReader(now)); err != nil {
+		logrus.WithError(err).Warn("could not record last access")
+	}
+}
+
+// cacheEntries pairs the archives with their last access sidecars. Sidecars
+// without an archive are returned separately.
+func cacheEntries(files []storage.FileEntry) ([]cacheEntry, []storage.FileEntry) {
+	sidecars := make(map[string]storage.FileEntry)
+	for _, file := range files {
+		if strings.HasSuffix(file.Path, accessSuffix) {
+			sidecars[strings.TrimSuffix(file.Path, accessSuffix)] = file
+		}
+	}
+
+	var entries []cacheEntry
+	for _, file := range files {
+		if strings.HasSuffix(file.Path, accessSuffix) {
+			continue
+		}
+
+		entry := cacheEntry{
+			FileEntry:  file,
+			LastAccess: file.LastModified,
+		}
+		if sidecar, ok := sidecars[file.Path]; ok {
+			entry.sidecar = sidecar.Path
+			if sidecar.LastModified.After(entry.LastAccess) {
+				entry.LastAccess = sidecar.LastModified
+			}
+			delete(sidecars, file.Path)
+		}
+		entries = append(entries, entry)
+	}
+
+	var orphans []storage.FileEntry
+	for _, sidecar := range sidecars {
+		orphans = append(orphans, sidecar)
+	}
+	return entries, orphans
+}
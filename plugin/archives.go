@@ -0,0 +1,74 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"net/url"
+	pathutil "path"
+	"path/filepath"
+
+	"github.com/drone-plugins/drone-s3-cache/archive/util"
+)
+
+// cacheArchive describes a single archive rebuilt or restored by the plugin.
+type cacheArchive struct {
+	name        string
+	key         string
+	filename    string
+	level       util.Level
+	restoreKeys []string
+	mounts      []string
+}
+
+// path returns the storage path of the archive under the key.
+func (a cacheArchive) path(root, key string) string {
+	return cleanPath(root, key, a.filename)
+}
+
+// archives returns the archives to process. By default all the mounts of a
+// cache are stored in a single archive, when archiving per mount each mount
+// is stored under the key in an archive named after the mount.
+func (p *Plugin) archives() []cacheArchive {
+	var archives []cacheArchive
+
+	for _, c := range p.settings.caches {
+		if !p.settings.ArchivePerMount {
+			archives = append(archives, cacheArchive{
+				name:        c.Name,
+				key:         c.Path,
+				filename:    c.Filename,
+				level:       c.level,
+				restoreKeys: c.RestoreKeys,
+				mounts:      c.Mount,
+			})
+			continue
+		}
+
+		for _, mount := range c.Mount {
+			name := mount
+			if c.Name != "" {
+				name = c.Name + "/" + mount
+			}
+
+			archives = append(archives, cacheArchive{
+				name:        name,
+				key:         c.Path,
+				filename:    mountFilename(mount, c.Filename),
+				level:       c.level,
+				restoreKeys: c.RestoreKeys,
+				mounts:      []string{mount},
+			})
+		}
+	}
+
+	return archives
+}
+
+// mountFilename returns the archive filename for a mount. The mount path is
+// escaped so it remains a single path segment.
+func mountFilename(mount, filename string) string {
+	return url.PathEscape(pathutil.Clean(filepath.ToSlash(mount))) + "." + filename
+}
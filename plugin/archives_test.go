@@ -0,0 +1,43 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"testing"
+)
+
+func TestArchivesPerMount(t *testing.T) {
+	mounts := []string{"node_modules", "./.m2/repository"}
+	p := &Plugin{
+		settings: Settings{
+			Root:            "bucket",
+			ArchivePerMount: true,
+			caches: []cacheDefinition{{
+				Path:     "foo/bar/main",
+				Filename: "archive.tar",
+				Mount:    mounts,
+			}},
+		},
+	}
+
+	archives := p.archives()
+	if len(archives) != 2 {
+		t.Fatalf("got %d archives, want 2", len(archives))
+	}
+
+	want := []string{
+		"bucket/foo/bar/main/node_modules.archive.tar",
+		"bucket/foo/bar/main/.m2%2Frepository.archive.tar",
+	}
+	for i, a := range archives {
+		if got := a.path(p.settings.Root, a.key); got != want[i] {
+			t.Errorf("got %s, want %s", got, want[i])
+		}
+		if len(a.mounts) != 1 || a.mounts[0] != mounts[i] {
+			t.Errorf("unexpected mounts %v", a.mounts)
+		}
+	}
+}
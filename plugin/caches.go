@@ -0,0 +1,183 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	pathutil "path"
+
+	"github.com/drone-plugins/drone-s3-cache/archive/util"
+	"github.com/sirupsen/logrus"
+)
+
+// cacheDefinition describes a named cache when processing multiple caches
+// in a single step.
+type cacheDefinition struct {
+	Name        string   `json:"name"`
+	Path        string   `json:"path"`
+	Filename    string   `json:"filename"`
+	Mount       []string `json:"mount"`
+	RestoreKeys []string `json:"restore-keys"`
+
+	// CompressionLevel overrides the compression level of the plugin
+	// settings for this cache.
+	CompressionLevel string `json:"compression-level"`
+
+	level util.Level
+}
+
+// validateCaches resolves the caches to process. Without any cache
+// definitions the plugin settings describe a single unnamed cache.
+func (p *Plugin) validateCaches() error {
+	if p.settings.Caches == "" {
+		c := cacheDefinition{
+			Path:     p.settings.Path,
+			Filename: p.settings.Filename,
+			Mount:    p.settings.mount,
+		}
+
+		if p.settings.Mode == rebuildMode {
+			if len(c.Mount) == 0 {
+				return fmt.Errorf("cache not specified")
+			}
+			if err := p.validateCompression(&c); err != nil {
+				return err
+			}
+		} else {
+			if p.settings.ArchivePerMount && len(c.Mount) == 0 {
+				return fmt.Errorf("cache not specified, mounts are required to restore per mount")
+			}
+			if p.settings.SkipUnchanged && len(c.Mount) == 0 {
+				logrus.Warn("no mounts specified, changes cannot be tracked for rebuild")
+			}
+
+			keys, err := p.renderRestoreKeys(c.Path, p.settings.FallbackPath, p.settings.RestoreKeys.Value())
+			if err != nil {
+				return err
+			}
+			c.RestoreKeys = keys
+			logrus.WithField("keys", keys).Debug("using restore keys")
+		}
+
+		p.settings.caches = []cacheDefinition{c}
+		return nil
+	}
+
+	var caches []cacheDefinition
+	if err := json.Unmarshal([]byte(p.settings.Caches), &caches); err != nil {
+		return fmt.Errorf("could not parse caches: %w", err)
+	}
+	if len(caches) == 0 {
+		return fmt.Errorf("no caches specified")
+	}
+
+	seen := make(map[string]bool)
+	for i := range caches {
+		c := &caches[i]
+
+		if c.Name == "" {
+			return fmt.Errorf("cache %d has no name", i)
+		}
+		if seen[c.Name] {
+			return fmt.Errorf("cache %s specified multiple times", c.Name)
+		}
+		seen[c.Name] = true
+
+		if len(c.Mount) == 0 && (p.settings.Mode == rebuildMode || p.settings.ArchivePerMount) {
+			return fmt.Errorf("cache %s has no mounts", c.Name)
+		}
+
+		var err error
+		if c.Path, err = renderTemplate(c.Path, p.pipeline, p.hashExcludes()); err != nil {
+			return err
+		}
+		if c.Path == "" {
+			c.Path = pathutil.Join(p.settings.Path, c.Name)
+		}
+		if c.Filename, err = renderTemplate(c.Filename, p.pipeline, p.hashExcludes()); err != nil {
+			return err
+		}
+		if c.Filename == "" {
+			c.Filename = p.settings.Filename
+		}
+
+		if p.settings.Mode == rebuildMode {
+			if err := p.validateCompression(c); err != nil {
+				return err
+			}
+		}
+
+		if p.settings.Mode == restoreMode {
+			fallback := pathutil.Join(p.settings.FallbackPath, c.Name)
+			if c.RestoreKeys, err = p.renderRestoreKeys(c.Path, fallback, c.RestoreKeys); err != nil {
+				return err
+			}
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"cache":    c.Name,
+			"path":     c.Path,
+			"filename": c.Filename,
+			"mount":    c.Mount,
+			"keys":     c.RestoreKeys,
+			"level":    c.level,
+		}).Debug("using cache")
+	}
+
+	p.settings.caches = caches
+	return nil
+}
+
+// validateCompression resolves the compression level of the cache, falling
+// back to the level in the plugin settings, and checks it is supported by
+// the archive format.
+func (p *Plugin) validateCompression(c *cacheDefinition) error {
+	value := c.CompressionLevel
+	if value == "" {
+		value = p.settings.CompressionLevel
+	}
+
+	level, err := util.ParseLevel(value)
+	if err != nil {
+		return err
+	}
+	if _, err := util.FromFilename(c.Filename, p.archiveOptions(level)); err != nil {
+		return err
+	}
+
+	c.level = level
+	return nil
+}
+
+// renderRestoreKeys returns the ordered keys to try on restore. The path is
+// always tried first followed by either the restore keys or the fallback path.
+func (p *Plugin) renderRestoreKeys(path, fallback string, restoreKeys []string) ([]string, error) {
+	candidates := []string{path}
+	if len(restoreKeys) != 0 {
+		for _, key := range restoreKeys {
+			rendered, err := renderTemplate(key, p.pipeline, p.hashExcludes())
+			if err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, rendered)
+		}
+	} else {
+		candidates = append(candidates, fallback)
+	}
+
+	var keys []string
+	seen := make(map[string]bool)
+	for _, key := range candidates {
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
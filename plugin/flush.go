@@ -0,0 +1,312 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/drone/drone-cache-lib/cache"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+)
+
+// flushPolicy selects the archives to delete from all the archives found
+// under the flush path.
+type flushPolicy func(entries []cacheEntry) []cacheEntry
+
+// flushPolicies returns the policies enabled by the settings. Expiring unused
+// archives replaces expiring archives by age.
+func (p *Plugin) flushPolicies(path string) []flushPolicy {
+	var policies []flushPolicy
+
+	if p.settings.FlushUnusedAge > 0 {
+		policies = append(policies, unusedPolicy(p.settings.FlushUnusedAge))
+	} else {
+		policies = append(policies, dirtyPolicy(genIsExpired(p.settings.FlushAge)))
+	}
+	if len(p.settings.flushBranches) != 0 {
+		policies = append(policies, deadBranchPolicy(path, p.settings.flushBranches, p.settings.flushBranchPattern))
+	}
+	if p.settings.FlushKeep > 0 {
+		policies = append(policies, keepNewestPolicy(path, p.settings.FlushKeep, p.settings.FlushKeepDepth))
+	}
+	if p.settings.flushMaxSize > 0 {
+		policies = append(policies, maxSizePolicy(p.settings.flushMaxSize))
+	}
+
+	return policies
+}
+
+// flush deletes the archives under the path selected by any of the policies
+// along with their last access sidecars. The policies are applied in order
+// and only see the archives not selected by an earlier policy. In a dry run
+// the archives are only reported and nothing is deleted.
+func (p *Plugin) flush(st storage.Storage, path string, policies ...flushPolicy) error {
+	// Only list below the path so sibling repositories sharing it as a
+	// prefix are not flushed
+	files, err := st.List(strings.TrimSuffix(path, "/") + "/")
+	if err != nil {
+		return err
+	}
+	entries, orphans := cacheEntries(files)
+
+	dirty := make(map[string]bool)
+	remaining := entries
+	for _, policy := range policies {
+		for _, entry := range policy(remaining) {
+			dirty[entry.Path] = true
+		}
+
+		remaining = nil
+		for _, entry := range entries {
+			if !dirty[entry.Path] {
+				remaining = append(remaining, entry)
+			}
+		}
+	}
+
+	var (
+		count int
+		total int64
+	)
+	for _, entry := range entries {
+		if !dirty[entry.Path] {
+			continue
+		}
+
+		log := logrus.WithFields(logrus.Fields{
+			"path":          entry.Path,
+			"size":          humanize.Bytes(uint64(entry.Size)),
+			"last-modified": entry.LastModified,
+			"last-access":   entry.LastAccess,
+		})
+
+		if p.settings.FlushDryRun {
+			log.Info("would delete object")
+		} else {
+			if err := st.Delete(entry.Path); err != nil {
+				return err
+			}
+			if entry.sidecar != "" {
+				if err := st.Delete(entry.sidecar); err != nil {
+					return err
+				}
+			}
+			log.Info("deleted object")
+		}
+
+		count++
+		total += entry.Size
+	}
+
+	for _, orphan := range orphans {
+		log := logrus.WithField("path", orphan.Path)
+		if p.settings.FlushDryRun {
+			log.Debug("would delete last access of missing archive")
+		} else {
+			if err := st.Delete(orphan.Path); err != nil {
+				return err
+			}
+			log.Debug("deleted last access of missing archive")
+		}
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"path":    path,
+		"objects": count,
+		"size":    humanize.Bytes(uint64(total)),
+	})
+	if p.settings.FlushDryRun {
+		log.Info("dry run, nothing was deleted")
+	} else {
+		log.Info("objects deleted")
+	}
+	return nil
+}
+
+// dirtyPolicy selects each archive the function considers dirty.
+func dirtyPolicy(dirty cache.DirtyFunc) flushPolicy {
+	return func(entries []cacheEntry) []cacheEntry {
+		var selected []cacheEntry
+		for _, entry := range entries {
+			if dirty(entry.FileEntry) {
+				selected = append(selected, entry)
+			}
+		}
+		return selected
+	}
+}
+
+// unusedPolicy selects the archives not used within the number of days.
+func unusedPolicy(age int) flushPolicy {
+	return func(entries []cacheEntry) []cacheEntry {
+		cutoff := time.Now().AddDate(0, 0, age*-1)
+
+		var selected []cacheEntry
+		for _, entry := range entries {
+			if entry.LastAccess.Before(cutoff) {
+				selected = append(selected, entry)
+			}
+		}
+		return selected
+	}
+}
+
+// deadBranchPolicy selects the archives below the path that are not within
+// the prefix of a live branch. Only archives whose first path segment matches
+// the pattern are treated as branch caches so other keys, such as shared or
+// content addressed ones, are kept. Archives directly within the path are
+// kept.
+func deadBranchPolicy(path string, branches []string, pattern *regexp.Regexp) flushPolicy {
+	return func(entries []cacheEntry) []cacheEntry {
+		var selected []cacheEntry
+		for _, entry := range entries {
+			rel, ok := relativePath(path, entry.Path)
+			if !ok {
+				continue
+			}
+			i := strings.Index(rel, "/")
+			if i == -1 {
+				continue
+			}
+
+			if !pattern.MatchString(rel[:i]) {
+				continue
+			}
+
+			live := false
+			for _, branch := range branches {
+				if strings.HasPrefix(rel, branch+"/") {
+					live = true
+					break
+				}
+			}
+			if !live {
+				selected = append(selected, entry)
+			}
+		}
+		return selected
+	}
+}
+
+// keepNewestPolicy keeps the newest versions of each cache below the path
+// and selects the rest. Archives are versions of the same cache when they
+// share a filename and the first depth directories of their path, which
+// with the default layout is the branch.
+func keepNewestPolicy(path string, keep, depth int) flushPolicy {
+	return func(entries []cacheEntry) []cacheEntry {
+		groups := make(map[string][]cacheEntry)
+		for _, entry := range entries {
+			rel, ok := relativePath(path, entry.Path)
+			if !ok {
+				continue
+			}
+			group := cacheGroup(rel, depth)
+			groups[group] = append(groups[group], entry)
+		}
+
+		var selected []cacheEntry
+		for group, versions := range groups {
+			if len(versions) <= keep {
+				continue
+			}
+
+			sort.SliceStable(versions, func(i, j int) bool {
+				return versions[i].LastModified.After(versions[j].LastModified)
+			})
+
+			logrus.WithFields(logrus.Fields{
+				"cache":   group,
+				"objects": len(versions),
+				"keep":    keep,
+			}).Debug("cache exceeds objects to keep")
+			selected = append(selected, versions[keep:]...)
+		}
+		return selected
+	}
+}
+
+// maxSizePolicy selects the least recently used archives until the total
+// size of the remaining archives fits within the budget.
+func maxSizePolicy(budget uint64) flushPolicy {
+	return func(entries []cacheEntry) []cacheEntry {
+		var total uint64
+		for _, entry := range entries {
+			total += uint64(entry.Size)
+		}
+		if total <= budget {
+			return nil
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"size":   humanize.Bytes(total),
+			"budget": humanize.Bytes(budget),
+		}).Debug("objects exceed size budget")
+
+		sorted := make([]cacheEntry, len(entries))
+		copy(sorted, entries)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return sorted[i].LastAccess.Before(sorted[j].LastAccess)
+		})
+
+		var selected []cacheEntry
+		for _, entry := range sorted {
+			if total <= budget {
+				break
+			}
+			selected = append(selected, entry)
+			total -= uint64(entry.Size)
+		}
+		return selected
+	}
+}
+
+// relativePath returns the path of the file below the path. False is
+// returned when the file is not below the path, such as a file of a sibling
+// repository sharing the path as a prefix.
+func relativePath(path, file string) (string, bool) {
+	prefix := strings.TrimSuffix(path, "/") + "/"
+	if !strings.HasPrefix(file, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(file, prefix), true
+}
+
+// cacheGroup returns the cache the archive at the relative path is a version
+// of, the first depth directories of the path joined with the filename.
+func cacheGroup(rel string, depth int) string {
+	segments := strings.Split(rel, "/")
+	dirs := segments[:len(segments)-1]
+	if len(dirs) > depth {
+		dirs = dirs[:depth]
+	}
+	return strings.Join(append(dirs, segments[len(segments)-1]), "/")
+}
+
+// readBranches reads the live branches from a file with a branch per line.
+// The output of git ls-remote --heads is also understood.
+func readBranches(file string) ([]string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not read branches: %w", err)
+	}
+
+	var branches []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		branches = append(branches, strings.TrimPrefix(fields[len(fields)-1], "refs/heads/"))
+	}
+	return branches, nil
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestFlushDryRun(t *testing.T) {
+	now := time.Now()
+	st := newMemStorage()
+	st.add("bucket/foo/bar/main/archive.tar", []byte("new"), now)
+	st.add("bucket/foo/bar/old/archive.tar", []byte("old"), now.AddDate(0, 0, -40))
+
+	p := &Plugin{settings: Settings{FlushDryRun: true}}
+	if err := p.flush(st, "bucket/foo/bar", dirtyPolicy(genIsExpired(30))); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.objects) != 2 {
+		t.Errorf("dry run deleted objects, %d remaining", len(st.objects))
+	}
+
+	p.settings.FlushDryRun = false
+	if err := p.flush(st, "bucket/foo/bar", dirtyPolicy(genIsExpired(30))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := st.objects["bucket/foo/bar/old/archive.tar"]; ok {
+		t.Error("expected expired object to be deleted")
+	}
+	if _, ok := st.objects["bucket/foo/bar/main/archive.tar"]; !ok {
+		t.Error("expected recent object to be kept")
+	}
+}
+
+func TestKeepNewestPolicy(t *testing.T) {
+	const (
+		sumA = "0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9"
+		sumB = "1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90a"
+		sumC = "2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f90a1b"
+	)
+
+	now := time.Now()
+	st := newMemStorage()
+	st.add("bucket/foo/bar/main/deps-"+sumA+"/archive.tar", nil, now.Add(-3*time.Hour))
+	st.add("bucket/foo/bar/main/deps-"+sumB+"/archive.tar", nil, now.Add(-2*time.Hour))
+	st.add("bucket/foo/bar/main/deps-"+sumC+"/archive.tar", nil, now.Add(-1*time.Hour))
+	st.add("bucket/foo/bar/main/other.tar", nil, now.Add(-4*time.Hour))
+	st.add("bucket/foo/bar/develop/1234/archive.tar", nil, now.Add(-3*time.Hour))
+	st.add("bucket/foo/bar/develop/1235/archive.tar", nil, now.Add(-2*time.Hour))
+	st.add("bucket/foo/bar/develop/1236/archive.tar", nil, now.Add(-1*time.Hour))
+	st.add("bucket/foo/bar/1234567-fix/archive.tar", nil, now.Add(-5*time.Hour))
+	st.add("bucket/foo/bar/7654321-fix/archive.tar", nil, now.Add(-4*time.Hour))
+	st.add("bucket/foo/bar/archive.tar", nil, now.Add(-6*time.Hour))
+	st.add("bucket/foo/bar-fork/main/deps-"+sumA+"/archive.tar", nil, now.Add(-6*time.Hour))
+
+	p := &Plugin{}
+	if err := p.flush(st, "bucket/foo/bar", keepNewestPolicy("bucket/foo/bar", 2, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, kept := range map[string]bool{
+		"bucket/foo/bar/main/deps-" + sumA + "/archive.tar":      false,
+		"bucket/foo/bar/main/deps-" + sumB + "/archive.tar":      true,
+		"bucket/foo/bar/main/deps-" + sumC + "/archive.tar":      true,
+		"bucket/foo/bar/main/other.tar":                          true,
+		"bucket/foo/bar/develop/1234/archive.tar":                false,
+		"bucket/foo/bar/develop/1235/archive.tar":                true,
+		"bucket/foo/bar/develop/1236/archive.tar":                true,
+		"bucket/foo/bar/1234567-fix/archive.tar":                 true,
+		"bucket/foo/bar/7654321-fix/archive.tar":                 true,
+		"bucket/foo/bar/archive.tar":                             true,
+		"bucket/foo/bar-fork/main/deps-" + sumA + "/archive.tar": true,
+	} {
+		if _, ok := st.objects[path]; ok != kept {
+			t.Errorf("%s kept %v, want %v", path, ok, kept)
+		}
+	}
+}
+
+func TestKeepNewestPolicyDepth(t *testing.T) {
+	now := time.Now()
+	st := newMemStorage()
+	st.add("bucket/foo/bar/main/npm/archive.tar", nil, now.Add(-3*time.Hour))
+	st.add("bucket/foo/bar/main/go/archive.tar", nil, now.Add(-2*time.Hour))
+	st.add("bucket/foo/bar/main/node_modules.archive.tar", nil, now.Add(-1*time.Hour))
+	st.add("bucket/foo/bar/main/.m2.archive.tar", nil, now)
+	st.add("bucket/foo/bar/feature/a/archive.tar", nil, now.Add(-2*time.Hour))
+	st.add("bucket/foo/bar/feature/b/archive.tar", nil, now.Add(-1*time.Hour))
+
+	p := &Plugin{}
+	if err := p.flush(st, "bucket/foo/bar", keepNewestPolicy("bucket/foo/bar", 1, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if len(st.objects) != 6 {
+		t.Errorf("got %d objects, want all 6 distinct caches kept", len(st.objects))
+	}
+
+	if err := p.flush(st, "bucket/foo/bar", keepNewestPolicy("bucket/foo/bar", 1, 1)); err != nil {
+		t.Fatal(err)
+	}
+	for path, kept := range map[string]bool{
+		"bucket/foo/bar/main/npm/archive.tar":          false,
+		"bucket/foo/bar/main/go/archive.tar":           true,
+		"bucket/foo/bar/main/node_modules.archive.tar": true,
+		"bucket/foo/bar/main/.m2.archive.tar":          true,
+		"bucket/foo/bar/feature/a/archive.tar":         false,
+		"bucket/foo/bar/feature/b/archive.tar":         true,
+	} {
+		if _, ok := st.objects[path]; ok != kept {
+			t.Errorf("%s kept %v, want %v", path, ok, kept)
+		}
+	}
+}
+
+func TestMaxSizePolicy(t *testing.T) {
+	now := time.Now()
+	st := newMemStorage()
+	st.add("bucket/foo/bar/main/archive.tar", make([]byte, 40), now)
+	st.add("bucket/foo/bar/feature/archive.tar", make([]byte, 40), now.Add(-1*time.Hour))
+	st.add("bucket/foo/bar/old/archive.tar", make([]byte, 40), now.Add(-2*time.Hour))
+
+	p := &Plugin{}
+	if err := p.flush(st, "bucket/foo/bar", maxSizePolicy(100)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := st.objects["bucket/foo/bar/old/archive.tar"]; ok {
+		t.Error("expected oldest object to be evicted")
+	}
+	if len(st.objects) != 2 {
+		t.Errorf("got %d objects, want 2", len(st.objects))
+	}
+}
+
+func TestUnusedPolicy(t *testing.T) {
+	now := time.Now()
+	st := newMemStorage()
+	st.add("bucket/foo/bar/main/archive.tar", nil, now.AddDate(0, 0, -40))
+	st.add("bucket/foo/bar/main/archive.tar"+accessSuffix, nil, now.AddDate(0, 0, -1))
+	st.add("bucket/foo/bar/old/archive.tar", nil, now.AddDate(0, 0, -40))
+	st.add("bucket/foo/bar/old/archive.tar"+accessSuffix, nil, now.AddDate(0, 0, -35))
+	st.add("bucket/foo/bar/gone/archive.tar"+accessSuffix, nil, now)
+
+	p := &Plugin{settings: Settings{FlushAge: 30, FlushUnusedAge: 30}}
+	if err := p.flush(st, "bucket/foo/bar", p.flushPolicies("bucket/foo/bar")...); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, kept := range map[string]bool{
+		"bucket/foo/bar/main/archive.tar":                true,
+		"bucket/foo/bar/main/archive.tar" + accessSuffix: true,
+		"bucket/foo/bar/old/archive.tar":                 false,
+		"bucket/foo/bar/old/archive.tar" + accessSuffix:  false,
+		"bucket/foo/bar/gone/archive.tar" + accessSuffix: false,
+	} {
+		if _, ok := st.objects[path]; ok != kept {
+			t.Errorf("%s kept %v, want %v", path, ok, kept)
+		}
+	}
+}
+
+func TestDeadBranchPolicy(t *testing.T) {
+	const sum = "3f786850e387550fdab836ed7e6dc881de23001b3f786850e387550fdab836ed"
+
+	now := time.Now()
+	st := newMemStorage()
+	st.add("bucket/foo/bar/main/archive.tar", nil, now)
+	st.add("bucket/foo/bar/feature/live/archive.tar", nil, now)
+	st.add("bucket/foo/bar/feature/dead/archive.tar", nil, now)
+	st.add("bucket/foo/bar/release-20240101/archive.tar", nil, now)
+	st.add("bucket/foo/bar/archive.tar", nil, now)
+	st.add("bucket/foo/bar/seed/archive.tar", nil, now)
+	st.add("bucket/foo/bar/"+sum+"/archive.tar", nil, now)
+	st.add("bucket/foo/bar-fork/main/archive.tar", nil, now)
+
+	p := &Plugin{}
+	pattern := regexp.MustCompile(`^(main|feature|release-.*)$`)
+	if err := p.flush(st, "bucket/foo/bar", deadBranchPolicy("bucket/foo/bar", []string{"main", "feature/live"}, pattern)); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, kept := range map[string]bool{
+		"bucket/foo/bar/main/archive.tar":             true,
+		"bucket/foo/bar/feature/live/archive.tar":     true,
+		"bucket/foo/bar/feature/dead/archive.tar":     false,
+		"bucket/foo/bar/release-20240101/archive.tar": false,
+		"bucket/foo/bar/archive.tar":                  true,
+		"bucket/foo/bar/seed/archive.tar":             true,
+		"bucket/foo/bar/" + sum + "/archive.tar":      true,
+		"bucket/foo/bar-fork/main/archive.tar":        true,
+	} {
+		if _, ok := st.objects[path]; ok != kept {
+			t.Errorf("%s kept %v, want %v", path, ok, kept)
+		}
+	}
+}
+
+func TestReadBranches(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "branches")
+	data := "abc123\trefs/heads/main\ndef456\trefs/heads/feature/x\n\nrelease\n"
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	branches, err := readBranches(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"main", "feature/x", "release"}
+	if !reflect.DeepEqual(branches, want) {
+		t.Errorf("got %v, want %v", branches, want)
+	}
+}
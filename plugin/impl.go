@@ -6,37 +6,75 @@
 package plugin
 
 import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"net/url"
 	"os"
 	pathutil "path"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/drone-plugins/drone-s3-cache/archive/util"
+	"github.com/drone-plugins/drone-s3-cache/storage/encrypted"
 	"github.com/drone-plugins/drone-s3-cache/storage/s3"
-	"github.com/drone/drone-cache-lib/archive/util"
 	"github.com/drone/drone-cache-lib/cache"
 	"github.com/drone/drone-cache-lib/storage"
+	"github.com/dustin/go-humanize"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
 // Settings for the plugin.
 type Settings struct {
-	Mode         string
-	Root         string
-	Filename     string
-	Path         string
-	FallbackPath string
-	FlushPath    string
-	FlushAge     int
-	Mount        cli.StringSlice
-	Restore      bool // DEPRECATED
-	Rebuild      bool // DEPRECATED
-	Flush        bool // DEPRECATED
-
-	S3Options s3.Options
-	mount     []string
+	Mode               string
+	Root               string
+	Filename           string
+	Path               string
+	FallbackPath       string
+	RestoreKeys        cli.StringSlice
+	RestorePrefix      bool
+	Immutable          bool
+	ArchivePerMount    bool
+	CompressionLevel   string
+	CompressionThreads int
+	SkipUnchanged      bool
+	TrackAccess        bool
+	Caches             string
+	FlushPath          string
+	FlushAge           int
+	FlushUnusedAge     int
+	FlushKeep          int
+	FlushKeepDepth     int
+	FlushBranches      cli.StringSlice
+	FlushBranchesFile  string
+	FlushBranchPattern string
+	FlushMaxSize       string
+	FlushDryRun        bool
+	Mount              cli.StringSlice
+	Restore            bool // DEPRECATED
+	Rebuild            bool // DEPRECATED
+	Flush              bool // DEPRECATED
+
+	DownloadPartSize    string
+	UploadPartSize      string
+	KMSContext          string
+	CustomerKey         string
+	ClientEncryptionKey string
+	SigningKey          string
+	VerifyKey           string
+	Tags                string
+	Metadata            string
+	Version             string
+	S3Options           s3.Options
+	mount               []string
+	caches              []cacheDefinition
+	flushMaxSize        uint64
+	flushBranches       []string
+	flushBranchPattern  *regexp.Regexp
 }
 
 const (
@@ -94,6 +132,10 @@ func (p *Plugin) validateMode() error {
 	logrus.WithField("mode", mode).Info("using mode")
 	p.settings.Mode = mode
 
+	if err := p.renderSettings(); err != nil {
+		return err
+	}
+
 	if p.settings.Filename == "" {
 		logrus.Debug("using default filename")
 		p.settings.Filename = "archive.tar"
@@ -117,13 +159,9 @@ func (p *Plugin) validateMode() error {
 		}
 		logrus.WithField("path", p.settings.Path).Debug("using path")
 
-		if mode == rebuildMode {
-			mount := p.settings.Mount.Value()
-			if len(mount) == 0 {
-				return fmt.Errorf("cache not specified")
-			}
-			p.settings.mount = mount
-		} else {
+		p.settings.mount = p.settings.Mount.Value()
+
+		if mode == restoreMode {
 			if p.settings.FallbackPath == "" {
 				logrus.WithFields(logrus.Fields{
 					"repo.owner":  p.pipeline.Repo.Owner,
@@ -139,6 +177,10 @@ func (p *Plugin) validateMode() error {
 			}
 			logrus.WithField("path", p.settings.FallbackPath).Debug("using path as fallback")
 		}
+
+		if err := p.validateCaches(); err != nil {
+			return err
+		}
 	} else {
 		if p.settings.FlushPath == "" {
 			logrus.WithFields(logrus.Fields{
@@ -152,11 +194,86 @@ func (p *Plugin) validateMode() error {
 			)
 		}
 		logrus.WithField("path", p.settings.FlushPath).Debug("using path when flushing")
+
+		if p.settings.FlushKeep > 0 && p.settings.FlushKeepDepth < 1 {
+			return fmt.Errorf("flush keep depth must be at least 1")
+		}
+
+		if p.settings.FlushMaxSize != "" {
+			size, err := humanize.ParseBytes(p.settings.FlushMaxSize)
+			if err != nil {
+				return fmt.Errorf("could not parse flush max size %s: %w", p.settings.FlushMaxSize, err)
+			}
+			p.settings.flushMaxSize = size
+		}
+
+		branches := p.settings.FlushBranches.Value()
+		if p.settings.FlushBranchesFile != "" {
+			fileBranches, err := readBranches(p.settings.FlushBranchesFile)
+			if err != nil {
+				return err
+			}
+			if len(fileBranches) == 0 {
+				return fmt.Errorf("no branches found in %s", p.settings.FlushBranchesFile)
+			}
+			branches = append(branches, fileBranches...)
+		}
+		if len(branches) != 0 && p.pipeline.Repo.Branch != "" {
+			// Never treat the default branch as dead
+			branches = append(branches, p.pipeline.Repo.Branch)
+		}
+		p.settings.flushBranches = branches
+		logrus.WithField("branches", branches).Debug("using live branches when flushing")
+
+		if len(branches) != 0 && p.settings.FlushBranchPattern == "" {
+			// Without it shared or content addressed keys look like dead
+			// branches and would be deleted
+			return fmt.Errorf("flush branch pattern is required to flush dead branches")
+		}
+		if p.settings.FlushBranchPattern != "" {
+			pattern, err := regexp.Compile(p.settings.FlushBranchPattern)
+			if err != nil {
+				return fmt.Errorf("could not parse flush branch pattern %s: %w", p.settings.FlushBranchPattern, err)
+			}
+			p.settings.flushBranchPattern = pattern
+		}
+	}
+
+	return nil
+}
+
+func (p *Plugin) renderSettings() error {
+	for _, setting := range []*string{
+		&p.settings.Filename,
+		&p.settings.Path,
+		&p.settings.FallbackPath,
+	} {
+		rendered, err := renderTemplate(*setting, p.pipeline, p.hashExcludes())
+		if err != nil {
+			return err
+		}
+		*setting = rendered
 	}
 
 	return nil
 }
 
+// hashExcludes returns the paths skipped when hashing files for a key, the
+// mounts of every cache and the plugin state. These change when the caches
+// are restored or filled which would change the key between steps.
+func (p *Plugin) hashExcludes() []string {
+	exclude := append([]string{stateDir}, p.settings.Mount.Value()...)
+
+	// Invalid cache definitions are reported when validating the caches
+	var caches []cacheDefinition
+	if err := json.Unmarshal([]byte(p.settings.Caches), &caches); err == nil {
+		for _, c := range caches {
+			exclude = append(exclude, c.Mount...)
+		}
+	}
+	return exclude
+}
+
 func (p *Plugin) validateS3() error {
 	// Validate the endpoint
 	endpoint := p.settings.S3Options.Endpoint
@@ -248,6 +365,83 @@ func (p *Plugin) validateS3() error {
 		}
 		p.settings.S3Options.Region = region
 	}
+	if p.settings.DownloadPartSize != "" {
+		size, err := humanize.ParseBytes(p.settings.DownloadPartSize)
+		if err != nil {
+			return fmt.Errorf("could not parse download part size %s: %w", p.settings.DownloadPartSize, err)
+		}
+		p.settings.S3Options.DownloadPartSize = int64(size)
+	}
+
+	if p.settings.UploadPartSize != "" {
+		size, err := humanize.ParseBytes(p.settings.UploadPartSize)
+		if err != nil {
+			return fmt.Errorf("could not parse upload part size %s: %w", p.settings.UploadPartSize, err)
+		}
+		if size < s3.MinPartSize {
+			return fmt.Errorf("upload part size %s is smaller than the minimum of %s", p.settings.UploadPartSize, humanize.IBytes(s3.MinPartSize))
+		}
+		p.settings.S3Options.UploadPartSize = int64(size)
+	}
+
+	if p.settings.KMSContext != "" {
+		if err := json.Unmarshal([]byte(p.settings.KMSContext), &p.settings.S3Options.KMSContext); err != nil {
+			return fmt.Errorf("could not parse kms context: %w", err)
+		}
+	}
+
+	if p.settings.CustomerKey != "" {
+		key, err := base64.StdEncoding.DecodeString(p.settings.CustomerKey)
+		if err != nil {
+			return fmt.Errorf("could not decode customer key: %w", err)
+		}
+		p.settings.S3Options.CustomerKey = key
+	}
+
+	if p.settings.Tags != "" {
+		if err := json.Unmarshal([]byte(p.settings.Tags), &p.settings.S3Options.Tags); err != nil {
+			return fmt.Errorf("could not parse tags: %w", err)
+		}
+	}
+
+	metadata := p.defaultMetadata()
+	if p.settings.Metadata != "" {
+		var user map[string]string
+		if err := json.Unmarshal([]byte(p.settings.Metadata), &user); err != nil {
+			return fmt.Errorf("could not parse metadata: %w", err)
+		}
+		for k, v := range user {
+			metadata[k] = v
+		}
+	}
+	p.settings.S3Options.Metadata = metadata
+
+	if p.settings.SigningKey != "" {
+		key, err := base64.StdEncoding.DecodeString(p.settings.SigningKey)
+		if err != nil {
+			return fmt.Errorf("could not decode signing key: %w", err)
+		}
+		switch len(key) {
+		case ed25519.SeedSize:
+			p.settings.S3Options.SigningKey = ed25519.NewKeyFromSeed(key)
+		case ed25519.PrivateKeySize:
+			p.settings.S3Options.SigningKey = ed25519.PrivateKey(key)
+		default:
+			return fmt.Errorf("signing key must be an ed25519 seed or private key")
+		}
+	}
+
+	if p.settings.VerifyKey != "" {
+		key, err := base64.StdEncoding.DecodeString(p.settings.VerifyKey)
+		if err != nil {
+			return fmt.Errorf("could not decode verify key: %w", err)
+		}
+		if len(key) != ed25519.PublicKeySize {
+			return fmt.Errorf("verify key must be an ed25519 public key")
+		}
+		p.settings.S3Options.VerifyKey = ed25519.PublicKey(key)
+	}
+
 	s3Opts := p.settings.S3Options
 
 	if (s3Opts.Access != "" || s3Opts.Secret != "") && s3Opts.FileCredentials != "" {
@@ -276,50 +470,90 @@ func (p *Plugin) validateS3() error {
 
 // Execute provides the implementation of the plugin.
 func (p *Plugin) Execute() error {
-	at, err := util.FromFilename(p.settings.Filename)
-	if err != nil {
-		return err
-	}
-
 	st, err := s3.New(&p.settings.S3Options)
+	if err == nil && p.settings.ClientEncryptionKey != "" {
+		st, err = encrypted.New(st, []byte(p.settings.ClientEncryptionKey))
+	}
 	if err != nil {
 		return err
 	}
 
-	c := cache.New(st, at)
-
 	if p.settings.Mode == rebuildMode {
-		path := cleanPath(p.settings.Root, p.settings.Path, p.settings.Filename)
-		logrus.WithFields(logrus.Fields{
-			"path": path,
-		}).Info("rebuilding cache")
-		err = c.Rebuild(p.settings.mount, path)
+		var lastErr error
+		failed := 0
+		for _, a := range p.archives() {
+			at, err := util.FromFilename(a.filename, p.archiveOptions(a.level))
+			if err != nil {
+				return err
+			}
 
-		if err == nil {
-			logrus.Infof("cache rebuilt")
+			path := a.path(p.settings.Root, a.key)
+			log := logrus.WithFields(logrus.Fields{
+				"path":      path,
+				"immutable": p.settings.Immutable,
+			})
+			if a.name != "" {
+				log = log.WithField("archive", a.name)
+			}
+			log.Info("rebuilding cache")
+
+			uploaded, err := p.rebuild(st, at, path, a.mounts)
+			if err != nil {
+				log.WithError(err).Error("could not rebuild cache")
+				failed++
+				lastErr = err
+			} else if uploaded {
+				log.Info("cache rebuilt")
+			}
 		}
+
+		if failed > 1 {
+			return fmt.Errorf("could not rebuild %d archives, last error: %w", failed, lastErr)
+		}
+		return lastErr
 	} else if p.settings.Mode == restoreMode {
-		path := cleanPath(p.settings.Root, p.settings.Path, p.settings.Filename)
-		fallbackPath := cleanPath(p.settings.Root, p.settings.FallbackPath, p.settings.Filename)
+		logrus.WithField("root", p.settings.Root).Info("restoring cache")
 
-		logrus.WithFields(logrus.Fields{
-			"path":     path,
-			"fallback": fallbackPath,
-		}).Info("restoring cache")
-		err = c.Restore(path, fallbackPath)
+		var results []restoreResult
+		for _, a := range p.archives() {
+			result, err := p.restore(st, a)
+			if err != nil {
+				return err
+			}
+			if result.Hit != cacheMiss {
+				if p.settings.TrackAccess {
+					recordAccess(st, result.Path)
+				}
 
-		if err == nil {
-			logrus.Info("cache restored")
+				logrus.WithFields(logrus.Fields{
+					"archive": a.name,
+					"path":    result.Path,
+				}).Info("cache restored")
+
+				if p.settings.SkipUnchanged && len(a.mounts) != 0 {
+					recordManifest(result.Path, a.mounts)
+				}
+			}
+			results = append(results, result)
+		}
+
+		if werr := writeResult(combineResults(results)); werr != nil {
+			logrus.WithError(werr).Warn("could not write restore result")
 		}
 	} else /* p.settings.Mode == flushMode */ {
 		flushPath := cleanPath(p.settings.Root, p.settings.FlushPath)
 
 		logrus.WithFields(logrus.Fields{
-			"path":    flushPath,
-			"max-age": p.settings.FlushAge,
+			"path":     flushPath,
+			"max-age":  p.settings.FlushAge,
+			"unused":   p.settings.FlushUnusedAge,
+			"keep":     p.settings.FlushKeep,
+			"depth":    p.settings.FlushKeepDepth,
+			"branches": len(p.settings.flushBranches),
+			"max-size": p.settings.FlushMaxSize,
+			"dry-run":  p.settings.FlushDryRun,
 		}).Info("flushing cache")
-		f := cache.NewFlusher(st, genIsExpired(p.settings.FlushAge))
-		err = f.Flush(flushPath)
+		err = p.flush(st, flushPath, p.flushPolicies(flushPath)...)
 
 		if err == nil {
 			logrus.Info("Cache flushed")
@@ -336,10 +570,50 @@ func genIsExpired(age int) cache.DirtyFunc {
 	}
 }
 
+// defaultMetadata returns the metadata describing the build that is added to
+// uploaded archives.
+func (p *Plugin) defaultMetadata() map[string]string {
+	metadata := make(map[string]string)
+	values := map[string]string{
+		"repo":           p.pipeline.Repo.Slug,
+		"branch":         p.pipeline.Commit.Branch,
+		"commit":         p.pipeline.Commit.SHA,
+		"plugin-version": p.settings.Version,
+	}
+	if p.pipeline.Build.Number != 0 {
+		values["build-number"] = strconv.Itoa(p.pipeline.Build.Number)
+	}
+
+	for k, v := range values {
+		if v != "" {
+			metadata[k] = v
+		}
+	}
+	return metadata
+}
+
+func (p *Plugin) archiveOptions(level util.Level) util.Options {
+	return util.Options{
+		Level:   level,
+		Threads: p.settings.CompressionThreads,
+	}
+}
+
 func cleanPath(paths ...string) string {
 	return pathutil.Clean(pathutil.Join(paths...))
 }
 
+// storagePath returns the path as the storage reports it, without a leading
+// slash and with the bucket lower cased, so paths built from the settings
+// can be compared with the paths of stored archives.
+func storagePath(p string) string {
+	p = strings.TrimPrefix(cleanPath(p), "/")
+	if i := strings.Index(p, "/"); i != -1 {
+		return strings.ToLower(p[:i]) + p[i:]
+	}
+	return strings.ToLower(p)
+}
+
 func multipleModesSpecified(bools ...bool) bool {
 	var b bool
 	for _, v := range bools {
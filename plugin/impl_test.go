@@ -6,7 +6,11 @@
 package plugin
 
 import (
+	"reflect"
 	"testing"
+
+	"github.com/drone-plugins/drone-plugin-lib/drone"
+	"github.com/drone-plugins/drone-s3-cache/archive/util"
 )
 
 func TestValidate(t *testing.T) {
@@ -16,3 +20,132 @@ func TestValidate(t *testing.T) {
 func TestExecute(t *testing.T) {
 	t.Skip()
 }
+
+func TestRenderRestoreKeys(t *testing.T) {
+	p := &Plugin{
+		pipeline: drone.Pipeline{Commit: drone.Commit{Branch: "feature"}},
+	}
+
+	keys, err := p.renderRestoreKeys(
+		"foo/bar/feature",
+		"foo/bar/main",
+		[]string{"foo/bar/{{ .Commit.Branch }}", "foo/bar/main", "foo/seed"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"foo/bar/feature", "foo/bar/main", "foo/seed"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+}
+
+func TestValidateCaches(t *testing.T) {
+	p := &Plugin{
+		settings: Settings{
+			Mode:         restoreMode,
+			Path:         "foo/bar/feature",
+			FallbackPath: "foo/bar/main",
+			Filename:     "archive.tar",
+			Caches: `[
+				{"name": "npm", "mount": ["node_modules"]},
+				{"name": "go", "path": "foo/bar/go-{{ .Commit.Branch }}", "filename": "go.tar.gz", "mount": ["/go/pkg"], "restore-keys": ["foo/bar/go-main"]}
+			]`,
+		},
+		pipeline: drone.Pipeline{Commit: drone.Commit{Branch: "feature"}},
+	}
+
+	if err := p.validateCaches(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []cacheDefinition{
+		{
+			Name:        "npm",
+			Path:        "foo/bar/feature/npm",
+			Filename:    "archive.tar",
+			Mount:       []string{"node_modules"},
+			RestoreKeys: []string{"foo/bar/feature/npm", "foo/bar/main/npm"},
+		},
+		{
+			Name:        "go",
+			Path:        "foo/bar/go-feature",
+			Filename:    "go.tar.gz",
+			Mount:       []string{"/go/pkg"},
+			RestoreKeys: []string{"foo/bar/go-feature", "foo/bar/go-main"},
+		},
+	}
+	if !reflect.DeepEqual(p.settings.caches, want) {
+		t.Errorf("got %+v, want %+v", p.settings.caches, want)
+	}
+
+	p.settings.Caches = `[{"name": "npm"}, {"name": "npm"}]`
+	if err := p.validateCaches(); err == nil {
+		t.Error("expected error for duplicate cache names")
+	}
+}
+
+func TestValidateCompression(t *testing.T) {
+	p := &Plugin{
+		settings: Settings{
+			Mode:             rebuildMode,
+			Path:             "foo/bar/main",
+			Filename:         "archive.tar.gz",
+			CompressionLevel: "best",
+			Caches: `[
+				{"name": "npm", "mount": ["node_modules"]},
+				{"name": "go", "filename": "go.tar.zst", "mount": ["/go/pkg"], "compression-level": "19"}
+			]`,
+		},
+	}
+
+	if err := p.validateCaches(); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.settings.caches[0].level; got != util.BestLevel {
+		t.Errorf("got level %s, want best", got)
+	}
+	if got := p.settings.caches[1].level; got != 19 {
+		t.Errorf("got level %s, want 19", got)
+	}
+
+	p.settings.Caches = `[{"name": "npm", "mount": ["node_modules"], "compression-level": "19"}]`
+	if err := p.validateCaches(); err == nil {
+		t.Error("expected error for level out of range for gzip")
+	}
+
+	p.settings.Caches = `[{"name": "npm", "mount": ["node_modules"], "compression-level": "max"}]`
+	if err := p.validateCaches(); err == nil {
+		t.Error("expected error for invalid level")
+	}
+}
+
+func TestDefaultMetadata(t *testing.T) {
+	p := &Plugin{
+		settings: Settings{
+			Version: "1.2.0",
+		},
+		pipeline: drone.Pipeline{
+			Repo:   drone.Repo{Slug: "foo/bar"},
+			Build:  drone.Build{Number: 42},
+			Commit: drone.Commit{SHA: "abc123", Branch: "main"},
+		},
+	}
+
+	want := map[string]string{
+		"repo":           "foo/bar",
+		"branch":         "main",
+		"commit":         "abc123",
+		"build-number":   "42",
+		"plugin-version": "1.2.0",
+	}
+	if got := p.defaultMetadata(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	p.pipeline.Commit.Branch = ""
+	if _, ok := p.defaultMetadata()["branch"]; ok {
+		t.Error("expected empty branch to be omitted")
+	}
+}
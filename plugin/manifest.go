@@ -0,0 +1,173 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stateDir is the directory within the workspace where the plugin keeps
+// state between steps.
+const stateDir = ".drone-cache"
+
+var manifestFile = filepath.Join(stateDir, "manifest.json")
+
+// manifest describes the content of the mounts restored from an archive.
+type manifest struct {
+	Mounts []string        `json:"mounts"`
+	Files  []manifestEntry `json:"files"`
+}
+
+type manifestEntry struct {
+	Path    string      `json:"path"`
+	Mode    fs.FileMode `json:"mode"`
+	Size    int64       `json:"size,omitempty"`
+	ModTime int64       `json:"mtime,omitempty"`
+	Link    string      `json:"link,omitempty"`
+}
+
+// buildManifest walks the mounts and records the files within them.
+func buildManifest(mounts []string) (manifest, error) {
+	m := manifest{Mounts: mounts}
+
+	for _, mount := range mounts {
+		if _, err := os.Lstat(mount); errors.Is(err, os.ErrNotExist) {
+			logrus.WithField("mount", mount).Debug("mount does not exist")
+			continue
+		}
+
+		err := filepath.Walk(mount, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			entry := manifestEntry{
+				Path: filepath.ToSlash(path),
+				Mode: fi.Mode(),
+			}
+
+			switch {
+			case fi.Mode().IsRegular():
+				entry.Size = fi.Size()
+				entry.ModTime = fi.ModTime().UnixNano()
+			case fi.Mode()&os.ModeSymlink != 0:
+				if entry.Link, err = os.Readlink(path); err != nil {
+					return err
+				}
+			}
+
+			m.Files = append(m.Files, entry)
+			return nil
+		})
+		if err != nil {
+			return manifest{}, fmt.Errorf("could not build manifest for %s: %w", mount, err)
+		}
+	}
+
+	return m, nil
+}
+
+// loadManifests reads the manifests recorded in the workspace keyed by the
+// archive path they were restored from.
+func loadManifests() (map[string]manifest, error) {
+	manifests := make(map[string]manifest)
+
+	data, err := os.ReadFile(manifestFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return manifests, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("could not read manifest: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return nil, fmt.Errorf("could not parse manifest %s: %w", manifestFile, err)
+	}
+	return manifests, nil
+}
+
+// saveManifest records the manifest for the archive path in the workspace.
+func saveManifest(archive string, m manifest) error {
+	manifests, err := loadManifests()
+	if err != nil {
+		return err
+	}
+	manifests[storagePath(archive)] = m
+
+	data, err := json.Marshal(manifests)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return fmt.Errorf("could not create %s: %w", stateDir, err)
+	}
+	if err := os.WriteFile(manifestFile, data, 0644); err != nil {
+		return fmt.Errorf("could not write manifest: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"archive": archive,
+		"files":   len(m.Files),
+	}).Debug("manifest recorded")
+	return nil
+}
+
+// recordManifest saves a manifest of the mounts restored from the archive.
+func recordManifest(archive string, mounts []string) {
+	m, err := buildManifest(mounts)
+	if err == nil {
+		err = saveManifest(archive, m)
+	}
+	if err != nil {
+		logrus.WithError(err).Warn("could not record manifest, rebuild will not be skipped")
+	}
+}
+
+// unchangedSinceRestore reports whether the mounts are identical to the ones
+// restored from the archive at path.
+func unchangedSinceRestore(archive string, mounts []string) bool {
+	log := logrus.WithField("path", archive)
+
+	manifests, err := loadManifests()
+	if err != nil {
+		log.WithError(err).Warn("could not load manifest")
+		return false
+	}
+
+	restored, ok := manifests[storagePath(archive)]
+	if !ok {
+		log.Info("mounts were not restored from this path, rebuilding")
+		return false
+	}
+
+	current, err := buildManifest(mounts)
+	if err != nil {
+		log.WithError(err).Warn("could not build manifest")
+		return false
+	}
+
+	if !reflect.DeepEqual(restored.Mounts, current.Mounts) {
+		log.Info("mounts differ from the restored cache, rebuilding")
+		return false
+	}
+	if !reflect.DeepEqual(restored.Files, current.Files) {
+		log.WithFields(logrus.Fields{
+			"restored": len(restored.Files),
+			"current":  len(current.Files),
+		}).Info("mount content changed since restore, rebuilding")
+		return false
+	}
+
+	return true
+}
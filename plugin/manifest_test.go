@@ -0,0 +1,56 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnchangedSinceRestore(t *testing.T) {
+	chdirTemp(t)
+
+	if err := os.MkdirAll(filepath.Join("node_modules", "pkg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join("node_modules", "pkg", "index.js"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts := []string{"node_modules"}
+	recordManifest("bucket/foo/bar/main/archive.tar", mounts)
+
+	if !unchangedSinceRestore("bucket/foo/bar/main/archive.tar", mounts) {
+		t.Error("expected mounts to be unchanged")
+	}
+	if !unchangedSinceRestore("/Bucket/foo/bar/main/archive.tar", mounts) {
+		t.Error("expected the path built from the root to match the stored path")
+	}
+	if unchangedSinceRestore("bucket/foo/bar/feature/archive.tar", mounts) {
+		t.Error("expected a different path to be treated as changed")
+	}
+
+	if err := os.WriteFile(filepath.Join("node_modules", "pkg", "other.js"), []byte("b"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if unchangedSinceRestore("bucket/foo/bar/main/archive.tar", mounts) {
+		t.Error("expected added file to be detected")
+	}
+}
+
+func chdirTemp(t *testing.T) {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
@@ -0,0 +1,65 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"github.com/drone-plugins/drone-s3-cache/archive/util"
+	"github.com/drone-plugins/drone-s3-cache/storage/s3"
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/cache"
+	"github.com/sirupsen/logrus"
+)
+
+// rebuild archives the mounts and uploads the archive to the path. It
+// reports whether an archive was uploaded.
+func (p *Plugin) rebuild(st s3.Storage, at archive.Archive, path string, mounts []string) (bool, error) {
+	if p.settings.Immutable {
+		entry, err := st.Stat(path)
+		switch {
+		case err == nil:
+			logrus.WithFields(logrus.Fields{
+				"path":          path,
+				"last-modified": entry.LastModified,
+			}).Info("cache is immutable and already exists, skipping rebuild")
+			return false, nil
+		case errors.Is(err, os.ErrNotExist):
+			logrus.WithField("path", path).Debug("immutable cache does not exist")
+		default:
+			logrus.WithError(err).Warn("could not check for existing cache, rebuilding")
+		}
+	}
+
+	if p.settings.SkipUnchanged && unchangedSinceRestore(path, mounts) {
+		logrus.WithField("path", path).Info("mounts unchanged since restore, skipping rebuild")
+		return false, nil
+	}
+
+	if err := cache.New(archiveStorage{st}, at).Rebuild(mounts, path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// archiveStorage uploads archives with the content type of their format.
+type archiveStorage struct {
+	s3.Storage
+}
+
+func (s archiveStorage) Put(p string, src io.Reader) error {
+	err := s.PutWithOptions(p, src, s3.PutOptions{ContentType: util.ContentType(p)})
+	if err != nil {
+		// The archive is packed into a pipe and the packer waits forever
+		// for the rest of it to be read unless the pipe is closed
+		if r, ok := src.(*io.PipeReader); ok {
+			r.CloseWithError(err)
+		}
+	}
+	return err
+}
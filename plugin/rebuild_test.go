@@ -0,0 +1,94 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/drone-plugins/drone-s3-cache/storage/encrypted"
+	"github.com/drone-plugins/drone-s3-cache/storage/s3"
+	"github.com/drone/drone-cache-lib/archive/tar"
+)
+
+func TestRebuildImmutable(t *testing.T) {
+	st := newMemStorage()
+	st.add("bucket/foo/bar/main/archive.tar", []byte("cached"), time.Now())
+
+	p := &Plugin{
+		settings: Settings{
+			Immutable: true,
+		},
+	}
+
+	uploaded, err := p.rebuild(st, nil, "bucket/foo/bar/main/archive.tar", []string{"cache"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded {
+		t.Error("expected rebuild to be skipped for an existing immutable cache")
+	}
+	if string(st.objects["bucket/foo/bar/main/archive.tar"]) != "cached" {
+		t.Error("expected existing cache to be left untouched")
+	}
+}
+
+func TestRebuildContentType(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), []byte("testing cache"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	st := newMemStorage()
+	p := &Plugin{}
+	if _, err := p.rebuild(st, tar.New(), "bucket/foo/bar/main/archive.tar", []string{dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := st.Stat("bucket/foo/bar/main/archive.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.ContentType != "application/x-tar" {
+		t.Errorf("got content type %q, want application/x-tar", info.ContentType)
+	}
+}
+
+func TestRebuildPutError(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "file"), make([]byte, 1<<20), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	failure := errors.New("upload failed")
+	st := newMemStorage()
+	st.putErr = failure
+
+	est, err := encrypted.New(st, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, st := range map[string]s3.Storage{"plain": st, "encrypted": est} {
+		done := make(chan error, 1)
+		go func() {
+			_, err := (&Plugin{}).rebuild(st, tar.New(), "bucket/foo/bar/main/archive.tar", []string{dir})
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if !errors.Is(err, failure) {
+				t.Errorf("%s: got %v, want %v", name, err, failure)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: rebuild did not return after the upload failed", name)
+		}
+	}
+}
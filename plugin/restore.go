@@ -0,0 +1,234 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	pathutil "path"
+	"strings"
+	"time"
+
+	"github.com/drone-plugins/drone-s3-cache/archive/util"
+	"github.com/drone-plugins/drone-s3-cache/storage/encrypted"
+	"github.com/drone-plugins/drone-s3-cache/storage/s3"
+	"github.com/drone/drone-cache-lib/archive"
+	"github.com/drone/drone-cache-lib/storage"
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+)
+
+// restore tries each of the restore keys of the archive in order and unpacks
+// the first one that exists.
+//
+// Like the cache library a failed restore is only logged so the build can
+// continue without the cache. An archive encrypted with another key is an
+// error as the encryption key is misconfigured.
+func (p *Plugin) restore(st s3.Storage, a cacheArchive) (restoreResult, error) {
+	start := time.Now()
+
+	for i, key := range a.restoreKeys {
+		path := a.path(p.settings.Root, key)
+		log := logrus.WithFields(logrus.Fields{
+			"key":  key,
+			"path": path,
+		})
+		if a.name != "" {
+			log = log.WithField("archive", a.name)
+		}
+
+		entry, matched, err := p.findArchive(st, key, a.filename)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				log.Info("cache miss, no archive found")
+			} else {
+				log.WithError(err).Warn("cache miss, could not check archive")
+			}
+			continue
+		}
+
+		if entry.Path != storagePath(path) {
+			log = log.WithField("path", entry.Path)
+		}
+
+		at, err := p.archiveFormat(entry)
+		if err != nil {
+			log.WithError(err).Warn("cache miss, unknown archive format")
+			continue
+		}
+
+		size, err := restoreArchive(st, at, entry.Path)
+		if errors.Is(err, encrypted.ErrWrongKey) {
+			return restoreResult{
+				Name:     a.name,
+				Hit:      cacheMiss,
+				Duration: time.Since(start).Seconds(),
+			}, fmt.Errorf("could not restore %s, check the encryption key: %w", entry.Path, err)
+		} else if errors.Is(err, s3.ErrUnsigned) || errors.Is(err, s3.ErrBadSignature) {
+			log.WithError(err).Warn("cache miss, ignoring archive without a valid signature")
+			continue
+		} else if errors.Is(err, s3.ErrChecksumMismatch) {
+			log.WithError(err).Warn("cache miss, archive is corrupted")
+			continue
+		} else if err != nil {
+			log.WithError(err).Warn("cache miss, could not restore archive")
+			continue
+		}
+
+		result := restoreResult{
+			Name:       a.name,
+			Hit:        fallbackHit,
+			MatchedKey: matched,
+			Path:       entry.Path,
+			Size:       size,
+			Duration:   time.Since(start).Seconds(),
+		}
+		if i == 0 && matched == key {
+			result.Hit = exactHit
+		}
+
+		log.WithFields(logrus.Fields{
+			"hit":  result.Hit,
+			"size": humanize.Bytes(uint64(size)),
+		}).Info("cache hit")
+		return result, nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"archive": a.name,
+		"keys":    a.restoreKeys,
+	}).Warn("cache could not be restored from any key")
+	return restoreResult{
+		Name:     a.name,
+		Hit:      cacheMiss,
+		Duration: time.Since(start).Seconds(),
+	}, nil
+}
+
+// keyFromPath returns the key of the stored archive at path relative to the
+// root.
+func (p *Plugin) keyFromPath(path string) string {
+	key := pathutil.Dir(path)
+	if p.settings.Root != "" {
+		key = strings.TrimPrefix(key, storagePath(p.settings.Root)+"/")
+	}
+	return key
+}
+
+// findArchive returns the archive stored at the key along with the key it
+// was found under. Archives stored using another archive format are also
+// found. When prefix matching is enabled and there is no exact match the
+// newest archive under the key is returned instead.
+func (p *Plugin) findArchive(st s3.Storage, key, filename string) (s3.FileInfo, string, error) {
+	names := util.Alternatives(filename)
+
+	for _, name := range names {
+		info, err := st.Stat(cleanPath(p.settings.Root, key, name))
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			return info, key, err
+		}
+	}
+
+	if !p.settings.RestorePrefix {
+		return s3.FileInfo{}, "", fmt.Errorf("no archive found for key %s: %w", key, os.ErrNotExist)
+	}
+
+	prefix := cleanPath(p.settings.Root, key)
+	if strings.HasSuffix(key, "/") {
+		prefix += "/"
+	}
+
+	entries, err := st.List(prefix)
+	if err != nil {
+		return s3.FileInfo{}, "", err
+	}
+
+	var newest *storage.FileEntry
+	for i, e := range entries {
+		if !contains(names, pathutil.Base(e.Path)) {
+			continue
+		}
+		if newest == nil || e.LastModified.After(newest.LastModified) {
+			newest = &entries[i]
+		}
+	}
+
+	if newest == nil {
+		return s3.FileInfo{}, "", fmt.Errorf("no archive found with prefix %s: %w", prefix, os.ErrNotExist)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"prefix":        prefix,
+		"path":          newest.Path,
+		"last-modified": newest.LastModified,
+	}).Debug("found newest archive matching prefix")
+	return s3.FileInfo{FileEntry: *newest}, p.keyFromPath(newest.Path), nil
+}
+
+// archiveFormat returns the archive format of a stored archive based on its
+// extension, falling back to its content type. The compression level does
+// not affect unpacking so the default is used.
+func (p *Plugin) archiveFormat(info s3.FileInfo) (archive.Archive, error) {
+	opts := p.archiveOptions(util.DefaultLevel)
+	at, err := util.FromFilename(info.Path, opts)
+	if err != nil && info.ContentType != "" {
+		return util.FromContentType(info.ContentType, opts)
+	}
+	return at, err
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreArchive unpacks the archive at path returning the number of bytes
+// downloaded.
+func restoreArchive(st s3.Storage, at archive.Archive, path string) (int64, error) {
+	reader, writer := io.Pipe()
+	counter := &countingWriter{w: writer}
+	cw := make(chan error, 1)
+	defer close(cw)
+
+	go func() {
+		err := st.Get(path, counter)
+		writer.CloseWithError(err)
+		cw <- err
+	}()
+
+	err := at.Unpack("", reader)
+	if err == nil {
+		// Drain any trailing padding so the download completes
+		_, err = io.Copy(io.Discard, reader)
+	}
+	reader.Close()
+
+	// The download fails once unpacking stops reading, otherwise its error
+	// explains why unpacking failed
+	werr := <-cw
+	if werr != nil && !errors.Is(werr, io.ErrClosedPipe) {
+		return counter.n, werr
+	}
+	return counter.n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
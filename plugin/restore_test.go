@@ -0,0 +1,305 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drone-plugins/drone-s3-cache/storage/encrypted"
+	"github.com/drone-plugins/drone-s3-cache/storage/s3"
+	"github.com/drone/drone-cache-lib/archive/tar"
+	"github.com/drone/drone-cache-lib/storage"
+)
+
+// memStorage is an in memory s3.Storage used for testing. Like S3 paths are
+// stored without a leading slash and with the bucket lower cased.
+type memStorage struct {
+	objects map[string][]byte
+	entries map[string]storage.FileEntry
+	types   map[string]string
+
+	// putErr is returned by Put without reading the source when set.
+	putErr error
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{
+		objects: make(map[string][]byte),
+		entries: make(map[string]storage.FileEntry),
+		types:   make(map[string]string),
+	}
+}
+
+func (s *memStorage) add(p string, data []byte, modified time.Time) {
+	s.objects[p] = data
+	s.entries[p] = storage.FileEntry{Path: p, Size: int64(len(data)), LastModified: modified}
+}
+
+func (s *memStorage) Get(p string, dst io.Writer) error {
+	p = storagePath(p)
+	data, ok := s.objects[p]
+	if !ok {
+		return fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	_, err := dst.Write(data)
+	return err
+}
+
+func (s *memStorage) Put(p string, src io.Reader) error {
+	if s.putErr != nil {
+		return s.putErr
+	}
+
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, src); err != nil {
+		return err
+	}
+	s.add(storagePath(p), b.Bytes(), time.Now())
+	return nil
+}
+
+func (s *memStorage) PutWithOptions(p string, src io.Reader, opts s3.PutOptions) error {
+	s.types[storagePath(p)] = opts.ContentType
+	return s.Put(p, src)
+}
+
+func (s *memStorage) List(p string) ([]storage.FileEntry, error) {
+	var entries []storage.FileEntry
+	for path, entry := range s.entries {
+		if strings.HasPrefix(path, p) {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Path < entries[j].Path })
+	return entries, nil
+}
+
+func (s *memStorage) Delete(p string) error {
+	p = storagePath(p)
+	delete(s.objects, p)
+	delete(s.entries, p)
+	return nil
+}
+
+func (s *memStorage) Stat(p string) (s3.FileInfo, error) {
+	p = storagePath(p)
+	entry, ok := s.entries[p]
+	if !ok {
+		return s3.FileInfo{}, fmt.Errorf("%s: %w", p, os.ErrNotExist)
+	}
+	return s3.FileInfo{FileEntry: entry, ContentType: s.types[p]}, nil
+}
+
+func TestFindArchive(t *testing.T) {
+	now := time.Now()
+	st := newMemStorage()
+	st.add("bucket/foo/bar/main/deps-a/archive.tar", nil, now.Add(-2*time.Hour))
+	st.add("bucket/foo/bar/main/deps-b/archive.tar", nil, now.Add(-1*time.Hour))
+	st.add("bucket/foo/bar/main/deps-c/other.tar", nil, now)
+
+	p := &Plugin{
+		settings: Settings{
+			Root: "bucket",
+		},
+	}
+
+	if _, _, err := p.findArchive(st, "foo/bar/main/deps-", "archive.tar"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected not exist without prefix matching, got %v", err)
+	}
+
+	p.settings.RestorePrefix = true
+
+	entry, _, err := p.findArchive(st, "foo/bar/main/deps-", "archive.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "bucket/foo/bar/main/deps-b/archive.tar"; entry.Path != want {
+		t.Errorf("got %s, want %s", entry.Path, want)
+	}
+
+	entry, _, err = p.findArchive(st, "foo/bar/main/deps-a", "archive.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "bucket/foo/bar/main/deps-a/archive.tar"; entry.Path != want {
+		t.Errorf("got %s, want %s", entry.Path, want)
+	}
+
+	if _, _, err := p.findArchive(st, "foo/bar/feature/", "archive.tar"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected not exist for unknown prefix, got %v", err)
+	}
+
+	entry, _, err = p.findArchive(st, "foo/bar/main/deps-a", "archive.tar.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "bucket/foo/bar/main/deps-a/archive.tar"; entry.Path != want {
+		t.Errorf("got %s, want %s for another archive format", entry.Path, want)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	chdirTemp(t)
+
+	if err := os.MkdirAll("cache", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("cache/test", []byte("testing cache"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	at := tar.New()
+	if err := at.Pack([]string{"cache"}, &b); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll("cache"); err != nil {
+		t.Fatal(err)
+	}
+
+	st := newMemStorage()
+	st.add("bucket/foo/bar/main/archive.tar", b.Bytes(), time.Now())
+
+	p := &Plugin{
+		settings: Settings{
+			Root: "bucket",
+		},
+	}
+	a := cacheArchive{
+		filename:    "archive.tar",
+		restoreKeys: []string{"foo/bar/feature", "foo/bar/main"},
+	}
+
+	result, err := p.restore(st, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Hit != fallbackHit {
+		t.Errorf("got hit %s, want %s", result.Hit, fallbackHit)
+	}
+	if result.MatchedKey != "foo/bar/main" {
+		t.Errorf("got matched key %s, want foo/bar/main", result.MatchedKey)
+	}
+	if result.Size != int64(b.Len()) {
+		t.Errorf("got size %d, want %d", result.Size, b.Len())
+	}
+
+	data, err := os.ReadFile("cache/test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "testing cache" {
+		t.Errorf("unexpected restored content %q", data)
+	}
+
+	a.restoreKeys = []string{"foo/bar/other"}
+	if result, _ := p.restore(st, a); result.Hit != cacheMiss {
+		t.Errorf("got hit %s, want %s", result.Hit, cacheMiss)
+	}
+
+	// The root is not in the form the storage reports paths in
+	p.settings.Root = "/Bucket"
+	a.restoreKeys = []string{"foo/bar/main"}
+	result, err = p.restore(st, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Hit != exactHit || result.MatchedKey != "foo/bar/main" {
+		t.Errorf("got hit %s for key %s, want %s for foo/bar/main", result.Hit, result.MatchedKey, exactHit)
+	}
+}
+
+// corruptStorage fails the checksum of the archive at the path.
+type corruptStorage struct {
+	*memStorage
+	path string
+}
+
+func (s corruptStorage) Get(p string, dst io.Writer) error {
+	if storagePath(p) == s.path {
+		return fmt.Errorf("%s: %w", p, s3.ErrChecksumMismatch)
+	}
+	return s.memStorage.Get(p, dst)
+}
+
+func TestRestoreCorrupted(t *testing.T) {
+	chdirTemp(t)
+
+	var b bytes.Buffer
+	if err := tar.New().Pack(nil, &b); err != nil {
+		t.Fatal(err)
+	}
+
+	st := newMemStorage()
+	st.add("bucket/foo/bar/feature/archive.tar", b.Bytes(), time.Now())
+	st.add("bucket/foo/bar/main/archive.tar", b.Bytes(), time.Now())
+
+	p := &Plugin{
+		settings: Settings{
+			Root: "bucket",
+		},
+	}
+	a := cacheArchive{
+		filename:    "archive.tar",
+		restoreKeys: []string{"foo/bar/feature", "foo/bar/main"},
+	}
+
+	result, err := p.restore(corruptStorage{st, "bucket/foo/bar/feature/archive.tar"}, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Hit != fallbackHit || result.MatchedKey != "foo/bar/main" {
+		t.Errorf("got hit %s for key %s, want %s for foo/bar/main", result.Hit, result.MatchedKey, fallbackHit)
+	}
+}
+
+func TestRestoreWrongKey(t *testing.T) {
+	chdirTemp(t)
+
+	var b bytes.Buffer
+	if err := tar.New().Pack(nil, &b); err != nil {
+		t.Fatal(err)
+	}
+
+	st := newMemStorage()
+	est, err := encrypted.New(st, []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := est.Put("bucket/foo/bar/main/archive.tar", &b); err != nil {
+		t.Fatal(err)
+	}
+
+	p := &Plugin{
+		settings: Settings{
+			Root: "bucket",
+		},
+	}
+	a := cacheArchive{
+		filename:    "archive.tar",
+		restoreKeys: []string{"foo/bar/main"},
+	}
+
+	if result, err := p.restore(est, a); err != nil || result.Hit != exactHit {
+		t.Errorf("got hit %s and %v, want %s", result.Hit, err, exactHit)
+	}
+
+	wrong, err := encrypted.New(st, []byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.restore(wrong, a); !errors.Is(err, encrypted.ErrWrongKey) {
+		t.Errorf("got %v, want %v", err, encrypted.ErrWrongKey)
+	}
+}
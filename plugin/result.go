@@ -0,0 +1,132 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	exactHit    = "exact"
+	fallbackHit = "fallback"
+	cacheMiss   = "miss"
+)
+
+var (
+	resultFile    = filepath.Join(stateDir, "result.json")
+	resultEnvFile = filepath.Join(stateDir, "result.env")
+)
+
+// restoreResult describes the outcome of a restore for later pipeline steps.
+type restoreResult struct {
+	Name       string          `json:"name,omitempty"`
+	Hit        string          `json:"hit"`
+	MatchedKey string          `json:"matched_key"`
+	Path       string          `json:"path,omitempty"`
+	Size       int64           `json:"size"`
+	Duration   float64         `json:"duration"`
+	Archives   []restoreResult `json:"archives,omitempty"`
+}
+
+// combineResults merges the results of restoring multiple archives. The hit
+// is only exact when every archive was an exact hit and a miss when none of
+// them were restored.
+func combineResults(results []restoreResult) restoreResult {
+	if len(results) == 1 {
+		return results[0]
+	}
+
+	combined := restoreResult{
+		Hit:      exactHit,
+		Archives: results,
+	}
+	misses := 0
+	for _, r := range results {
+		combined.Size += r.Size
+		combined.Duration += r.Duration
+
+		switch r.Hit {
+		case cacheMiss:
+			misses++
+			combined.Hit = fallbackHit
+		case fallbackHit:
+			combined.Hit = fallbackHit
+		}
+	}
+	if misses == len(results) {
+		combined.Hit = cacheMiss
+	}
+
+	return combined
+}
+
+// env returns the result as environment variables. The result of each named
+// archive is also included using the name in the variable.
+func (r restoreResult) env() map[string]string {
+	env := make(map[string]string)
+	r.addEnv(env, "CACHE_")
+	for _, archive := range r.Archives {
+		if archive.Name != "" {
+			archive.addEnv(env, "CACHE_"+envName(archive.Name)+"_")
+		}
+	}
+	return env
+}
+
+func (r restoreResult) addEnv(env map[string]string, prefix string) {
+	env[prefix+"HIT"] = r.Hit
+	env[prefix+"MATCHED_KEY"] = r.MatchedKey
+	env[prefix+"SIZE"] = strconv.FormatInt(r.Size, 10)
+	env[prefix+"DURATION"] = strconv.FormatFloat(r.Duration, 'f', 3, 64)
+}
+
+// envName converts the name to upper case replacing anything that is not
+// allowed in an environment variable name.
+func envName(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.Trim(name, "./"))
+}
+
+// writeResult writes the restore result to the workspace as json and as a
+// dotenv file that can be sourced by later steps.
+func writeResult(r restoreResult) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(stateDir, 0755); err != nil {
+		return fmt.Errorf("could not create %s: %w", stateDir, err)
+	}
+	if err := os.WriteFile(resultFile, data, 0644); err != nil {
+		return fmt.Errorf("could not write result: %w", err)
+	}
+	if err := godotenv.Write(r.env(), resultEnvFile); err != nil {
+		return fmt.Errorf("could not write result: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"file": resultFile,
+		"env":  resultEnvFile,
+	}).Debug("restore result written")
+	return nil
+}
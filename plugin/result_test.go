@@ -0,0 +1,36 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"testing"
+)
+
+func TestCombineResults(t *testing.T) {
+	result := combineResults([]restoreResult{
+		{Name: "npm", Hit: exactHit, MatchedKey: "foo/bar/main/npm", Size: 10},
+		{Name: "go/.cache/go-build", Hit: cacheMiss},
+	})
+
+	if result.Hit != fallbackHit {
+		t.Errorf("got hit %s, want %s", result.Hit, fallbackHit)
+	}
+	if result.Size != 10 {
+		t.Errorf("got size %d, want 10", result.Size)
+	}
+
+	env := result.env()
+	for key, want := range map[string]string{
+		"CACHE_HIT":                    fallbackHit,
+		"CACHE_NPM_HIT":                exactHit,
+		"CACHE_NPM_MATCHED_KEY":        "foo/bar/main/npm",
+		"CACHE_GO__CACHE_GO_BUILD_HIT": cacheMiss,
+	} {
+		if env[key] != want {
+			t.Errorf("got %s=%q, want %q", key, env[key], want)
+		}
+	}
+}
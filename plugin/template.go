@@ -0,0 +1,183 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	pathutil "path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/drone-plugins/drone-plugin-lib/drone"
+	"github.com/sirupsen/logrus"
+)
+
+// renderTemplate renders a cache key template against the pipeline. The
+// excluded paths are skipped when hashing files.
+func renderTemplate(text string, pipeline drone.Pipeline, exclude []string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New("key").Option("missingkey=error").Funcs(templateFuncs(exclude)).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("could not parse template %q: %w", text, err)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, pipeline); err != nil {
+		return "", fmt.Errorf("could not render template %q: %w", text, err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"template": text,
+		"result":   b.String(),
+	}).Debug("rendered template")
+	return b.String(), nil
+}
+
+func templateFuncs(exclude []string) template.FuncMap {
+	return template.FuncMap{
+		"hashFiles": func(patterns ...string) (string, error) {
+			return hashFiles(exclude, patterns...)
+		},
+		"env":   os.Getenv,
+		"arch":  func() string { return runtime.GOARCH },
+		"os":    func() string { return runtime.GOOS },
+		"epoch": func() string { return strconv.FormatInt(time.Now().Unix(), 10) },
+	}
+}
+
+// hashFiles returns the SHA-256 of all files in the workspace matching the
+// patterns. Patterns use forward slashes and support ** to match any number
+// of directories. An error is returned when nothing matches so unrelated
+// repositories missing the files do not share a key. The excluded paths,
+// such as the cache mounts, are skipped so the hash is the same before and
+// after the caches are filled.
+func hashFiles(exclude []string, patterns ...string) (string, error) {
+	skip, err := excludedPaths(exclude)
+	if err != nil {
+		return "", fmt.Errorf("could not hash files: %w", err)
+	}
+
+	var files []string
+	err = filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if skip[filepath.Clean(path)] {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		name := filepath.ToSlash(path)
+		for _, pattern := range patterns {
+			if matchPattern(strings.TrimPrefix(pattern, "./"), name) {
+				files = append(files, path)
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not hash files: %w", err)
+	}
+
+	if len(files) == 0 {
+		return "", fmt.Errorf("no files found to hash matching %s", strings.Join(patterns, ", "))
+	}
+
+	sort.Strings(files)
+	sum := sha256.New()
+	for _, file := range files {
+		logrus.WithField("file", file).Debug("hashing file")
+		f, err := os.Open(file)
+		if err != nil {
+			return "", fmt.Errorf("could not hash files: %w", err)
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", fmt.Errorf("could not hash file %s: %w", file, err)
+		}
+		sum.Write(h.Sum(nil))
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// excludedPaths returns the set of paths relative to the workspace to skip
+// when hashing files.
+func excludedPaths(exclude []string) (map[string]bool, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	skip := make(map[string]bool)
+	for _, path := range exclude {
+		if filepath.IsAbs(path) {
+			if path, err = filepath.Rel(wd, path); err != nil {
+				continue
+			}
+		}
+		skip[filepath.Clean(path)] = true
+	}
+	return skip, nil
+}
+
+// matchPattern reports whether the slash separated name matches the pattern,
+// where a ** segment matches zero or more path segments.
+func matchPattern(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := pathutil.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+
+	return len(name) == 0
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/drone-plugins/drone-plugin-lib/drone"
+)
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"go.sum", "go.sum", true},
+		{"go.sum", "sub/go.sum", false},
+		{"**/package-lock.json", "package-lock.json", true},
+		{"**/package-lock.json", "a/b/package-lock.json", true},
+		{"a/**/*.lock", "a/x/y/z.lock", true},
+		{"a/**/*.lock", "b/x/z.lock", false},
+		{"*.json", "a/b.json", false},
+	}
+
+	for _, test := range tests {
+		if got := matchPattern(test.pattern, test.name); got != test.match {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", test.pattern, test.name, got, test.match)
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	pipeline := drone.Pipeline{
+		Repo:   drone.Repo{Owner: "foo", Name: "bar"},
+		Commit: drone.Commit{Branch: "main"},
+	}
+	t.Setenv("GOVERSION", "1.19")
+
+	got, err := renderTemplate(`{{ .Repo.Owner }}/{{ .Repo.Name }}/{{ .Commit.Branch }}/go{{ env "GOVERSION" }}`, pipeline, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "foo/bar/main/go1.19"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := renderTemplate(`{{ .Commit.Branch`, pipeline, nil); err == nil {
+		t.Error("expected error for invalid template")
+	}
+}
+
+func TestHashFiles(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "go.sum"), []byte("testing cache"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	sum, err := hashFiles(nil, "go.sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum == "" {
+		t.Error("expected a hash for a matching file")
+	}
+
+	if _, err := renderTemplate(`deps-{{ hashFiles "package-lock.json" }}`, drone.Pipeline{}, nil); err == nil {
+		t.Error("expected error when no files match")
+	}
+}
+
+func TestHashFilesExcludesMounts(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "package.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	exclude := []string{"node_modules", stateDir}
+	before, err := hashFiles(exclude, "**/package.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mount := range []string{"node_modules/left-pad", stateDir} {
+		if err := os.MkdirAll(mount, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(mount, "package.json"), []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	after, err := hashFiles(exclude, "**/package.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Error("expected files within the mounts to be excluded from the hash")
+	}
+
+	all, err := hashFiles(nil, "**/package.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if all == after {
+		t.Error("expected files within the mounts to be hashed without exclusions")
+	}
+}
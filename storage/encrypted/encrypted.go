@@ -0,0 +1,336 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+// Package encrypted encrypts archives on the client before they are stored.
+//
+// Archives are encrypted with AES-256-GCM in chunks so they can be streamed.
+// A random salt is stored in the header and the keys for each archive are
+// derived from the secret and salt with scrypt, so a secret cannot be guessed
+// cheaply from a stored archive. Each chunk uses its index as the nonce with
+// the last chunk flagged so reordered, dropped or truncated chunks fail to
+// authenticate.
+package encrypted
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/drone-plugins/drone-s3-cache/storage/s3"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// chunkSize is the amount of plaintext encrypted in each chunk.
+	chunkSize = 64 << 10
+
+	saltSize  = 32
+	checkSize = 16
+
+	// The scrypt parameters recommended for interactive use.
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var magic = []byte("DCACHEv2")
+
+var (
+	// ErrWrongKey is returned when an archive was encrypted with another key.
+	ErrWrongKey = errors.New("archive was encrypted with a different key")
+
+	// ErrNotEncrypted is returned when reading an archive that was not
+	// encrypted.
+	ErrNotEncrypted = errors.New("archive is not encrypted")
+
+	// ErrCorrupted is returned when an archive fails to authenticate.
+	ErrCorrupted = errors.New("archive is corrupted or truncated")
+)
+
+// encryptedStorage encrypts objects before they are put and decrypts them
+// when they are retrieved.
+type encryptedStorage struct {
+	s3.Storage
+	secret []byte
+}
+
+// New wraps the storage so archives are encrypted using the secret.
+func New(st s3.Storage, secret []byte) (s3.Storage, error) {
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("no encryption key specified")
+	}
+	return &encryptedStorage{Storage: st, secret: secret}, nil
+}
+
+func (s *encryptedStorage) Put(p string, src io.Reader) error {
+	return s.PutWithOptions(p, src, s3.PutOptions{})
+}
+
+func (s *encryptedStorage) PutWithOptions(p string, src io.Reader, opts s3.PutOptions) error {
+	reader, writer := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		w, err := NewWriter(writer, s.secret)
+		if err == nil {
+			if _, err = io.Copy(w, src); err == nil {
+				err = w.Close()
+			}
+		}
+		writer.CloseWithError(err)
+	}()
+
+	err := s.Storage.PutWithOptions(p, reader, opts)
+	reader.CloseWithError(err)
+	if err != nil {
+		// Unblock the writer of a piped source and the encryption waiting
+		// on it, neither can finish once the upload stops reading
+		if r, ok := src.(*io.PipeReader); ok {
+			r.CloseWithError(err)
+		}
+	}
+	<-done
+	return err
+}
+
+func (s *encryptedStorage) Get(p string, dst io.Writer) error {
+	reader, writer := io.Pipe()
+	cw := make(chan error, 1)
+
+	go func() {
+		err := s.Storage.Get(p, writer)
+		writer.CloseWithError(err)
+		cw <- err
+	}()
+
+	r, err := NewReader(reader, s.secret)
+	if err == nil {
+		_, err = io.Copy(dst, r)
+	}
+	reader.CloseWithError(err)
+
+	werr := <-cw
+	if err != nil {
+		return fmt.Errorf("could not decrypt %s: %w", p, err)
+	}
+	return werr
+}
+
+// Writer encrypts the data written to it.
+type Writer struct {
+	w     io.Writer
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+	err   error
+}
+
+// NewWriter writes the header to w and returns a writer that encrypts to w.
+// Close must be called to write the final chunk.
+func NewWriter(w io.Writer, secret []byte) (*Writer, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key, check, err := deriveKey(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := append(append(append([]byte{}, magic...), salt...), check...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:    w,
+		aead: aead,
+		buf:  make([]byte, 0, chunkSize),
+	}, nil
+}
+
+func (w *Writer) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	written := 0
+	for len(b) > 0 {
+		// Only flush a full chunk once more data arrives so the last chunk
+		// is always written by Close
+		if len(w.buf) == chunkSize {
+			if w.err = w.flush(false); w.err != nil {
+				return written, w.err
+			}
+		}
+
+		n := copy(w.buf[len(w.buf):chunkSize], b)
+		w.buf = w.buf[:len(w.buf)+n]
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close writes the final chunk. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.flush(true)
+	if w.err == nil {
+		w.err = errors.New("write to closed writer")
+		return nil
+	}
+	return w.err
+}
+
+func (w *Writer) flush(last bool) error {
+	sealed := w.aead.Seal(nil, nonce(w.index, last), w.buf, nil)
+	w.index++
+	w.buf = w.buf[:0]
+
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(sealed)))
+	if _, err := w.w.Write(length[:]); err != nil {
+		return err
+	}
+	_, err := w.w.Write(sealed)
+	return err
+}
+
+// Reader decrypts the data read from it.
+type Reader struct {
+	r     io.Reader
+	aead  cipher.AEAD
+	buf   []byte
+	index uint64
+	done  bool
+}
+
+// NewReader reads the header from r and returns a reader that decrypts r.
+// ErrWrongKey is returned when the archive was encrypted with another key.
+func NewReader(r io.Reader, secret []byte) (*Reader, error) {
+	header := make([]byte, len(magic)+saltSize+checkSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(magic)], magic) {
+		return nil, ErrNotEncrypted
+	}
+
+	salt := header[len(magic) : len(magic)+saltSize]
+	key, check, err := deriveKey(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(check, header[len(magic)+saltSize:]) {
+		return nil, ErrWrongKey
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, aead: aead}, nil
+}
+
+func (r *Reader) Read(b []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *Reader) next() error {
+	var length [4]byte
+	if _, err := io.ReadFull(r.r, length[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrCorrupted
+		}
+		return err
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size > chunkSize+uint32(r.aead.Overhead()) {
+		return ErrCorrupted
+	}
+
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(r.r, sealed); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ErrCorrupted
+		}
+		return err
+	}
+
+	// A chunk only authenticates as the last one if it was written last
+	for _, last := range []bool{false, true} {
+		plain, err := r.aead.Open(sealed[:0:0], nonce(r.index, last), sealed, nil)
+		if err == nil {
+			r.buf = plain
+			r.index++
+			r.done = last
+			return nil
+		}
+	}
+	return ErrCorrupted
+}
+
+// deriveKey derives the key for an archive from the secret and salt along
+// with a value used to check the key on decryption. The check is computed
+// with its own subkey so it reveals nothing about the encryption key.
+func deriveKey(secret, salt []byte) (key, check []byte, err error) {
+	keys, err := scrypt.Key(secret, salt, scryptN, scryptR, scryptP, 64)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mac := hmac.New(sha256.New, keys[32:])
+	mac.Write([]byte("key check"))
+	return keys[:32], mac.Sum(nil)[:checkSize], nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce returns the nonce for the chunk at index.
+func nonce(index uint64, last bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[3:11], index)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
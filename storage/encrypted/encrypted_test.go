@@ -0,0 +1,111 @@
+// Copyright (c) 2020, the Drone Plugins project authors.
+// Please see the AUTHORS file for details. All rights reserved.
+// Use of this source code is governed by an Apache 2.0 license that can be
+// found in the LICENSE file.
+
+package encrypted
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func encrypt(t *testing.T, data, secret []byte) []byte {
+	t.Helper()
+
+	var b bytes.Buffer
+	w, err := NewWriter(&b, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func decrypt(data, secret []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(data), secret)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	secret := []byte("secret")
+
+	for _, size := range []int{0, 1, chunkSize, chunkSize + 1, 3*chunkSize + 100} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		encrypted := encrypt(t, data, secret)
+		// A short random plaintext appears in random looking output by
+		// chance, a single byte almost always does, so only longer ones
+		// show the data was not encrypted
+		if size >= 16 && bytes.Contains(encrypted, data) {
+			t.Errorf("size %d: plaintext found in output", size)
+		}
+
+		decrypted, err := decrypt(encrypted, secret)
+		if err != nil {
+			t.Fatalf("size %d: %s", size, err)
+		}
+		if !bytes.Equal(decrypted, data) {
+			t.Errorf("size %d: decrypted data differs", size)
+		}
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	data := make([]byte, 2*chunkSize+10)
+	rand.Read(data)
+	encrypted := encrypt(t, data, []byte("secret"))
+
+	if _, err := decrypt(encrypted, []byte("other")); !errors.Is(err, ErrWrongKey) {
+		t.Errorf("got %v, want %v", err, ErrWrongKey)
+	}
+
+	if _, err := decrypt(data, []byte("secret")); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("got %v, want %v", err, ErrNotEncrypted)
+	}
+
+	// Drop the last chunk
+	truncated := encrypted[:len(magic)+saltSize+checkSize+2*(4+chunkSize+16)]
+	if _, err := decrypt(truncated, []byte("secret")); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("got %v, want %v for a truncated archive", err, ErrCorrupted)
+	}
+
+	tampered := append([]byte{}, encrypted...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := decrypt(tampered, []byte("secret")); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("got %v, want %v for a tampered archive", err, ErrCorrupted)
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	key, check, err := deriveKey([]byte("secret"), make([]byte, saltSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 || len(check) != checkSize {
+		t.Fatalf("got key of %d bytes and check of %d bytes", len(key), len(check))
+	}
+	if bytes.Contains(key, check) {
+		t.Error("key check reveals the encryption key")
+	}
+
+	other, _, err := deriveKey([]byte("secret"), bytes.Repeat([]byte{1}, saltSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(key, other) {
+		t.Error("expected the salt to change the key")
+	}
+}
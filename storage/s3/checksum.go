@@ -0,0 +1,66 @@
+package s3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// checksumKey is the user metadata key holding the SHA-256 of an object.
+const checksumKey = "sha256"
+
+// ErrChecksumMismatch is returned when a downloaded object does not match
+// the checksum recorded when it was uploaded.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// checksum returns the SHA-256 recorded in the user metadata of an object.
+func checksum(metadata map[string]string) string {
+	return metadataValue(metadata, checksumKey)
+}
+
+// metadataValue returns the value of a user metadata key. The keys returned
+// by S3 are canonicalized so they are matched ignoring case.
+func metadataValue(metadata map[string]string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+	return ""
+}
+
+// getVerified downloads the object to a temporary file using get and only
+// copies it to dst once its SHA-256 matches the expected checksum. This way
+// a corrupted or truncated object is never partially extracted.
+func getVerified(dst io.Writer, want string, get func(w io.Writer) (int64, error)) (int64, error) {
+	file, err := os.CreateTemp("", "drone-cache-*")
+	if err != nil {
+		return 0, fmt.Errorf("could not create download file: %w", err)
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	hash := sha256.New()
+	size, err := get(io.MultiWriter(file, hash))
+	if err != nil {
+		return size, err
+	}
+
+	if got := hex.EncodeToString(hash.Sum(nil)); !strings.EqualFold(got, want) {
+		return size, fmt.Errorf("%w, got %s expected %s", ErrChecksumMismatch, got, want)
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return size, err
+	}
+	if _, err := io.Copy(dst, file); err != nil {
+		return size, permanentError{err}
+	}
+	return size, nil
+}
@@ -0,0 +1,43 @@
+package s3
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestGetVerified(t *testing.T) {
+	get := func(data string) func(w io.Writer) (int64, error) {
+		return func(w io.Writer) (int64, error) {
+			return io.Copy(w, strings.NewReader(data))
+		}
+	}
+	sum := "ffa8aae68c7e42a5d635eb00723712ee2848bb161a0ec6c27725814cf00dec76"
+
+	var b bytes.Buffer
+	if _, err := getVerified(&b, sum, get("testing cache")); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "testing cache" {
+		t.Errorf("unexpected content %q", b.String())
+	}
+
+	b.Reset()
+	if _, err := getVerified(&b, sum, get("testing cach")); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("got %v, want %v", err, ErrChecksumMismatch)
+	}
+	if b.Len() != 0 {
+		t.Error("expected nothing written for a mismatched checksum")
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	if got := checksum(map[string]string{"Sha256": "abc"}); got != "abc" {
+		t.Errorf("got %s, want abc", got)
+	}
+	if got := checksum(nil); got != "" {
+		t.Errorf("got %s, want no checksum", got)
+	}
+}
@@ -0,0 +1,194 @@
+package s3
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultPartSize is the size of the parts an object is split into when the
+// part size is not specified.
+const DefaultPartSize = 16 << 20
+
+// rangeFunc retrieves the bytes of an object between start and end inclusive.
+type rangeFunc func(ctx context.Context, start, end int64) ([]byte, error)
+
+// partResult is a downloaded part waiting to be written.
+type partResult struct {
+	data []byte
+	err  error
+}
+
+// getRanges downloads the object in parts fetched concurrently and writes
+// them to dst in order. At most concurrency parts are downloading or waiting
+// to be written at any time which bounds the memory used.
+func getRanges(ctx context.Context, dst io.Writer, size, partSize int64, concurrency int, fetch rangeFunc) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	parts := int((size + partSize - 1) / partSize)
+	results := make([]chan partResult, parts)
+	for i := range results {
+		results[i] = make(chan partResult, 1)
+	}
+
+	slots := make(chan struct{}, concurrency)
+	go func() {
+		for i := 0; i < parts; i++ {
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+
+			start := int64(i) * partSize
+			end := start + partSize - 1
+			if end >= size {
+				end = size - 1
+			}
+
+			go func(i int, start, end int64) {
+				data, err := fetch(ctx, start, end)
+				if err == nil && int64(len(data)) != end-start+1 {
+					err = fmt.Errorf("part %d is %d bytes, expected %d", i, len(data), end-start+1)
+				}
+				results[i] <- partResult{data: data, err: err}
+			}(i, start, end)
+		}
+	}()
+
+	var written int64
+	for i := 0; i < parts; i++ {
+		var result partResult
+		select {
+		case result = <-results[i]:
+		case <-ctx.Done():
+			return written, ctx.Err()
+		}
+		if result.err != nil {
+			return written, fmt.Errorf("could not download part %d: %w", i, result.err)
+		}
+
+		n, err := dst.Write(result.data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		<-slots
+	}
+
+	return written, nil
+}
+
+// getObject downloads the object writing it to dst. Objects larger than a
+// single part are downloaded using concurrent range requests when more than
+// one connection is allowed.
+func (s *s3Storage) getObject(ctx context.Context, bucket, key string, dst io.Writer) (int64, error) {
+	partSize := s.opts.DownloadPartSize
+	if partSize <= 0 {
+		partSize = DefaultPartSize
+	}
+	log := logrus.WithFields(logrus.Fields{
+		"bucket": bucket,
+		"key":    key,
+	})
+
+	if s.opts.DownloadConcurrency > 1 {
+		var info minio.ObjectInfo
+		err := s.request(ctx, log, func(ctx context.Context) error {
+			var err error
+			info, err = s.client.StatObject(ctx, bucket, key, minio.StatObjectOptions{ServerSideEncryption: s.sse})
+			return err
+		})
+		if err != nil {
+			return 0, fmt.Errorf("could not stat %s in bucket %s: %w", key, bucket, err)
+		}
+
+		if info.Size > partSize {
+			log.WithFields(logrus.Fields{
+				"parts":       (info.Size + partSize - 1) / partSize,
+				"concurrency": s.opts.DownloadConcurrency,
+			}).Debug("downloading parts concurrently")
+
+			fetch := func(ctx context.Context, start, end int64) ([]byte, error) {
+				var data []byte
+				err := retry(ctx, s.opts.Retries, 0, log.WithField("range", fmt.Sprintf("%d-%d", start, end)), func(ctx context.Context) error {
+					return watchIdle(ctx, s.opts.IdleTimeout, func(ctx context.Context, touch func()) error {
+						var err error
+						data, err = s.getRange(ctx, bucket, key, info.ETag, start, end, touch)
+						return err
+					})
+				})
+				return data, err
+			}
+
+			return getRanges(ctx, dst, info.Size, partSize, s.opts.DownloadConcurrency, fetch)
+		}
+	}
+
+	return s.getStream(ctx, bucket, key, dst, log)
+}
+
+// getRange downloads the bytes of the object between start and end.
+func (s *s3Storage) getRange(ctx context.Context, bucket, key, etag string, start, end int64, touch func()) ([]byte, error) {
+	opts := minio.GetObjectOptions{ServerSideEncryption: s.sse}
+	// Fail rather than mix parts if the object is replaced
+	if err := opts.SetMatchETag(etag); err != nil {
+		return nil, err
+	}
+	if err := opts.SetRange(start, end); err != nil {
+		return nil, err
+	}
+
+	core := minio.Core{Client: s.client}
+	body, _, _, err := core.GetObject(ctx, bucket, key, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data := make([]byte, end-start+1)
+	n, err := io.ReadFull(&progressReader{r: body, touch: touch}, data)
+	return data[:n], err
+}
+
+// getStream downloads the object using a single connection. When the
+// connection is interrupted the download resumes from the last byte received.
+func (s *s3Storage) getStream(ctx context.Context, bucket, key string, dst io.Writer, log *logrus.Entry) (int64, error) {
+	w := &offsetWriter{w: dst}
+	etag := ""
+
+	err := retry(ctx, s.opts.Retries, 0, log, func(ctx context.Context) error {
+		return watchIdle(ctx, s.opts.IdleTimeout, func(ctx context.Context, touch func()) error {
+			opts := minio.GetObjectOptions{ServerSideEncryption: s.sse}
+			if etag != "" {
+				// Fail rather than resume from a replaced object
+				if err := opts.SetMatchETag(etag); err != nil {
+					return err
+				}
+			}
+			if w.n > 0 {
+				log.WithField("offset", w.n).Info("resuming download")
+				if err := opts.SetRange(w.n, 0); err != nil {
+					return err
+				}
+			}
+
+			core := minio.Core{Client: s.client}
+			body, info, _, err := core.GetObject(ctx, bucket, key, opts)
+			if err != nil {
+				return fmt.Errorf("could not retrieve %s from %s: %w", key, bucket, err)
+			}
+			defer body.Close()
+			etag = info.ETag
+
+			_, err = io.Copy(w, &progressReader{r: body, touch: touch})
+			return err
+		})
+	})
+
+	return w.n, err
+}
@@ -0,0 +1,157 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestGetRanges(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	var active, peak int32
+	fetch := func(ctx context.Context, start, end int64) ([]byte, error) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+
+		// Finish parts out of order
+		time.Sleep(time.Duration(rand.Intn(5)) * time.Millisecond)
+		return data[start : end+1], nil
+	}
+
+	var b bytes.Buffer
+	n, err := getRanges(context.Background(), &b, int64(len(data)), 64, 3, fetch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(b.Bytes(), data) {
+		t.Error("parts were not reassembled in order")
+	}
+	if peak > 3 {
+		t.Errorf("got %d concurrent parts, want at most 3", peak)
+	}
+}
+
+func TestGetRangesError(t *testing.T) {
+	failure := errors.New("connection reset")
+	fetch := func(ctx context.Context, start, end int64) ([]byte, error) {
+		if start == 128 {
+			return nil, failure
+		}
+		return make([]byte, end-start+1), nil
+	}
+
+	var b bytes.Buffer
+	n, err := getRanges(context.Background(), &b, 1000, 64, 4, fetch)
+	if !errors.Is(err, failure) {
+		t.Errorf("got error %v, want %v", err, failure)
+	}
+	if n != 128 {
+		t.Errorf("got %d bytes written, want 128", n)
+	}
+
+	short := func(ctx context.Context, start, end int64) ([]byte, error) {
+		return make([]byte, 1), nil
+	}
+	if _, err := getRanges(context.Background(), &b, 1000, 64, 4, short); err == nil {
+		t.Error("expected error for a short part")
+	}
+}
+
+func TestGetStreamResume(t *testing.T) {
+	setRetryDelay(t, time.Millisecond)
+
+	data := make([]byte, 1000)
+	rand.Read(data)
+	const (
+		cut  = 300
+		etag = `"0123456789abcdef"`
+	)
+
+	var requests int32
+	var ranges, matches []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		ranges = append(ranges, r.Header.Get("Range"))
+		matches = append(matches, r.Header.Get("If-Match"))
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+
+		if n == 1 {
+			// Cut the connection partway through the body
+			w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+			w.WriteHeader(http.StatusOK)
+			w.Write(data[:cut])
+			w.(http.Flusher).Flush()
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			conn.Close()
+			return
+		}
+
+		start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.Header.Get("Range"), "bytes="), "-"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)-start))
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start:])
+	}))
+	defer server.Close()
+
+	st, err := New(&Options{
+		Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		Access:   "access",
+		Secret:   "secret",
+		Region:   "us-east-1",
+		Retries:  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	n, err := st.(*s3Storage).getStream(context.Background(), "bucket", "key", &b, logrus.NewEntry(logrus.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(b.Bytes(), data) {
+		t.Errorf("got %d bytes, want the %d bytes of the object", n, len(data))
+	}
+
+	if len(ranges) != 2 {
+		t.Fatalf("got %d requests, want 2", len(ranges))
+	}
+	if ranges[0] != "" || matches[0] != "" {
+		t.Errorf("got range %q and etag %q for the first request, want neither", ranges[0], matches[0])
+	}
+	if want := fmt.Sprintf("bytes=%d-", cut); ranges[1] != want {
+		t.Errorf("got range %q, want %q", ranges[1], want)
+	}
+	if matches[1] != etag {
+		t.Errorf("got etag %q, want %q", matches[1], etag)
+	}
+}
@@ -0,0 +1,46 @@
+package s3
+
+import (
+	"fmt"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+// Server side encryption methods.
+const (
+	EncryptionS3       = "sse-s3"
+	EncryptionKMS      = "sse-kms"
+	EncryptionCustomer = "sse-c"
+)
+
+// serverSide returns the server side encryption for the options. Objects are
+// not encrypted when nil is returned.
+func serverSide(opts *Options) (encrypt.ServerSide, error) {
+	if opts.Encryption != EncryptionKMS && (opts.KMSKeyID != "" || len(opts.KMSContext) != 0) {
+		return nil, fmt.Errorf("kms key and context require %s encryption", EncryptionKMS)
+	}
+	if opts.Encryption != EncryptionCustomer && len(opts.CustomerKey) != 0 {
+		return nil, fmt.Errorf("customer key requires %s encryption", EncryptionCustomer)
+	}
+
+	switch opts.Encryption {
+	case "":
+		return nil, nil
+	case EncryptionS3:
+		return encrypt.NewSSE(), nil
+	case EncryptionKMS:
+		// A nil map would still be sent as an empty context
+		if len(opts.KMSContext) == 0 {
+			return encrypt.NewSSEKMS(opts.KMSKeyID, nil)
+		}
+		return encrypt.NewSSEKMS(opts.KMSKeyID, opts.KMSContext)
+	case EncryptionCustomer:
+		sse, err := encrypt.NewSSEC(opts.CustomerKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid customer key: %w", err)
+		}
+		return sse, nil
+	}
+
+	return nil, fmt.Errorf("unknown encryption %s", opts.Encryption)
+}
@@ -0,0 +1,48 @@
+package s3
+
+import (
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+)
+
+func TestServerSide(t *testing.T) {
+	key := make([]byte, 32)
+
+	tests := []struct {
+		opts Options
+		want encrypt.Type
+		err  bool
+	}{
+		{opts: Options{}},
+		{opts: Options{Encryption: EncryptionS3}, want: encrypt.S3},
+		{opts: Options{Encryption: EncryptionKMS, KMSKeyID: "key", KMSContext: map[string]string{"repo": "foo/bar"}}, want: encrypt.KMS},
+		{opts: Options{Encryption: EncryptionCustomer, CustomerKey: key}, want: encrypt.SSEC},
+		{opts: Options{Encryption: EncryptionCustomer, CustomerKey: key[:16]}, err: true},
+		{opts: Options{Encryption: EncryptionS3, KMSKeyID: "key"}, err: true},
+		{opts: Options{CustomerKey: key}, err: true},
+		{opts: Options{Encryption: "aes"}, err: true},
+	}
+
+	for _, test := range tests {
+		sse, err := serverSide(&test.opts)
+		if test.err {
+			if err == nil {
+				t.Errorf("expected error for %+v", test.opts)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected error for %+v: %s", test.opts, err)
+			continue
+		}
+
+		if sse == nil {
+			if test.want != "" {
+				t.Errorf("got no encryption, want %s", test.want)
+			}
+		} else if sse.Type() != test.want {
+			t.Errorf("got %s, want %s", sse.Type(), test.want)
+		}
+	}
+}
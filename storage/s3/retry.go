@@ -0,0 +1,258 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	// retryDelay is the time waited before the first retry, each retry after
+	// doubles the delay up to maxRetryDelay.
+	retryDelay = time.Second
+
+	// maxRetryDelay is the longest time waited between retries.
+	maxRetryDelay = 30 * time.Second
+)
+
+// maxErrorSize limits the error responses read to classify failures.
+const maxErrorSize = 64 << 10
+
+// errIdle is returned when a transfer makes no progress within the idle
+// timeout.
+var errIdle = errors.New("transfer stalled")
+
+// permanentError is an error retrying the request cannot fix, such as
+// failing to write downloaded data to its destination.
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// retry calls fn until it succeeds, fails with an error that cannot be
+// retried or has been retried the number of times. Each attempt is limited
+// to the timeout when it is not 0. The delay between attempts grows
+// exponentially with jitter so concurrent builds do not retry in lockstep.
+func retry(ctx context.Context, retries int, timeout time.Duration, log *logrus.Entry, fn func(ctx context.Context) error) error {
+	delay := retryDelay
+
+	for attempt := 1; ; attempt++ {
+		err := withTimeout(ctx, timeout, fn)
+		if err == nil || ctx.Err() != nil || !retryable(err) || attempt > retries {
+			return err
+		}
+
+		// Wait between half and the full delay
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		log.WithError(err).WithFields(logrus.Fields{
+			"attempt": attempt,
+			"retries": retries,
+			"delay":   wait,
+		}).Warn("request failed, retrying")
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+
+		if delay *= 2; delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+	}
+}
+
+// withTimeout calls fn as a single attempt with a context limited to the
+// timeout. The attempt fails on the first request that fails so it is not
+// also retried by the client, see attemptTransport.
+func withTimeout(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+
+	a := &attempt{cancel: cancel}
+	err := fn(context.WithValue(ctx, attemptKey{}, a))
+	if failure := a.failure(); err != nil && failure != nil {
+		return failure
+	}
+	return err
+}
+
+// attemptKey is the context key of the attempt a request belongs to.
+type attemptKey struct{}
+
+// attempt records the first failed request of an attempt.
+type attempt struct {
+	mu     sync.Mutex
+	err    error
+	cancel context.CancelFunc
+}
+
+// fail records the failure and cancels the attempt.
+func (a *attempt) fail(err error) {
+	a.mu.Lock()
+	if a.err == nil {
+		a.err = err
+	}
+	a.mu.Unlock()
+	a.cancel()
+}
+
+func (a *attempt) failure() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// attemptTransport fails the attempt of a request when the request fails in
+// a way that can be retried. minio-go retries failed requests itself, failing
+// the attempt stops it so requests are only retried by the storage with the
+// configured number of retries.
+type attemptTransport struct {
+	http.RoundTripper
+}
+
+func (t attemptTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	a, ok := req.Context().Value(attemptKey{}).(*attempt)
+	res, err := t.RoundTripper.RoundTrip(req)
+	if !ok {
+		return res, err
+	}
+
+	if err != nil {
+		if retryable(err) {
+			a.fail(err)
+		}
+		return res, err
+	}
+	if res.StatusCode < 400 {
+		return res, nil
+	}
+
+	// Read the error so it can be classified, the client reads it again
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxErrorSize))
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(data))
+	if err != nil {
+		if retryable(err) {
+			a.fail(err)
+		}
+		return res, nil
+	}
+
+	resp := minio.ErrorResponse{}
+	if len(data) != 0 {
+		xml.Unmarshal(data, &resp)
+	}
+	resp.StatusCode = res.StatusCode
+	if resp.Message == "" {
+		resp.Message = res.Status
+	}
+	if retryable(resp) {
+		a.fail(resp)
+	}
+	return res, nil
+}
+
+// retryable reports whether the request that failed with err can be retried.
+// Server errors, throttling, timeouts and dropped connections are retried.
+func retryable(err error) bool {
+	var perr permanentError
+	if errors.As(err, &perr) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	if resp := minio.ToErrorResponse(err); resp.StatusCode != 0 {
+		switch resp.Code {
+		case "SlowDown", "Throttling", "ThrottlingException", "RequestTimeout", "RequestLimitExceeded":
+			return true
+		}
+		return resp.StatusCode >= 500 || resp.StatusCode == 429 || resp.StatusCode == 408
+	}
+
+	var nerr net.Error
+	switch {
+	case errors.Is(err, errIdle),
+		errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, io.ErrUnexpectedEOF),
+		errors.Is(err, syscall.ECONNRESET),
+		errors.Is(err, syscall.ECONNREFUSED),
+		errors.Is(err, syscall.EPIPE),
+		errors.As(err, &nerr) && nerr.Timeout():
+		return true
+	}
+	return false
+}
+
+// watchIdle calls fn cancelling its context when touch is not called within
+// the timeout. A timeout of 0 never cancels.
+func watchIdle(ctx context.Context, timeout time.Duration, fn func(ctx context.Context, touch func()) error) error {
+	if timeout <= 0 {
+		return fn(ctx, func() {})
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var idle int32
+	timer := time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&idle, 1)
+		cancel()
+	})
+	defer timer.Stop()
+
+	err := fn(ctx, func() { timer.Reset(timeout) })
+	if err != nil && atomic.LoadInt32(&idle) == 1 {
+		return fmt.Errorf("%w, no data for %s: %v", errIdle, timeout, err)
+	}
+	return err
+}
+
+// progressReader calls touch whenever data is read.
+type progressReader struct {
+	r     io.Reader
+	touch func()
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.touch()
+	}
+	return n, err
+}
+
+// offsetWriter tracks the number of bytes written so an interrupted download
+// can be resumed from the last byte received.
+type offsetWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	n, err := o.w.Write(b)
+	o.n += int64(n)
+	if err != nil {
+		return n, permanentError{err}
+	}
+	return n, nil
+}
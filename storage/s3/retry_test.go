@@ -0,0 +1,138 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{minio.ErrorResponse{StatusCode: 503, Code: "SlowDown"}, true},
+		{minio.ErrorResponse{StatusCode: 500, Code: "InternalError"}, true},
+		{minio.ErrorResponse{StatusCode: 400, Code: "RequestTimeout"}, true},
+		{minio.ErrorResponse{StatusCode: 404, Code: "NoSuchKey"}, false},
+		{minio.ErrorResponse{StatusCode: 403, Code: "AccessDenied"}, false},
+		{fmt.Errorf("read: %w", syscall.ECONNRESET), true},
+		{io.ErrUnexpectedEOF, true},
+		{fmt.Errorf("%w: no data", errIdle), true},
+		{permanentError{syscall.ECONNRESET}, false},
+		{context.Canceled, false},
+		{errors.New("invalid argument"), false},
+	}
+
+	for _, test := range tests {
+		if got := retryable(test.err); got != test.want {
+			t.Errorf("retryable(%v) = %t, want %t", test.err, got, test.want)
+		}
+	}
+}
+
+// setRetryDelay changes the delay before retrying until the test finishes.
+func setRetryDelay(t *testing.T, delay time.Duration) {
+	old := retryDelay
+	retryDelay = delay
+	t.Cleanup(func() { retryDelay = old })
+}
+
+func TestRetry(t *testing.T) {
+	setRetryDelay(t, time.Millisecond)
+	log := logrus.NewEntry(logrus.StandardLogger())
+
+	attempts := 0
+	err := retry(context.Background(), 2, 0, log, func(ctx context.Context) error {
+		attempts++
+		return minio.ErrorResponse{StatusCode: 503}
+	})
+	if err == nil || attempts != 3 {
+		t.Errorf("got %d attempts, want 3", attempts)
+	}
+
+	attempts = 0
+	err = retry(context.Background(), 2, 0, log, func(ctx context.Context) error {
+		attempts++
+		return minio.ErrorResponse{StatusCode: 404, Code: "NoSuchKey"}
+	})
+	if err == nil || attempts != 1 {
+		t.Errorf("got %d attempts, want 1 for an error that cannot be retried", attempts)
+	}
+
+	attempts = 0
+	err = retry(context.Background(), 2, time.Millisecond, log, func(ctx context.Context) error {
+		attempts++
+		if attempts == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("got %d attempts and %v, want a retry after the timeout", attempts, err)
+	}
+}
+
+func TestWatchIdle(t *testing.T) {
+	err := watchIdle(context.Background(), 10*time.Millisecond, func(ctx context.Context, touch func()) error {
+		for i := 0; i < 5; i++ {
+			time.Sleep(5 * time.Millisecond)
+			touch()
+		}
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Errorf("unexpected error while making progress: %v", err)
+	}
+
+	err = watchIdle(context.Background(), 10*time.Millisecond, func(ctx context.Context, touch func()) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, errIdle) {
+		t.Errorf("got %v, want %v", err, errIdle)
+	}
+}
+
+func TestAttemptTransport(t *testing.T) {
+	setRetryDelay(t, time.Millisecond)
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	st, err := New(&Options{
+		Endpoint: strings.TrimPrefix(server.URL, "http://"),
+		Access:   "access",
+		Secret:   "secret",
+		Region:   "us-east-1",
+		Retries:  2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = st.Stat("bucket/key")
+	var resp minio.ErrorResponse
+	if !errors.As(err, &resp) || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got %v, want the service unavailable response", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 3 {
+		t.Errorf("got %d requests, want 3 for 2 retries", got)
+	}
+}
@@ -2,14 +2,19 @@ package s3
 
 import (
 	"context"
+	"crypto/ed25519"
 	"fmt"
 	"io"
+	"net"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/drone/drone-cache-lib/storage"
 	"github.com/dustin/go-humanize"
 	"github.com/minio/minio-go/v7"
 	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
 	"github.com/sirupsen/logrus"
 )
 
@@ -35,16 +40,117 @@ type Options struct {
 	Region string
 
 	UseSSL bool
+
+	// DownloadConcurrency is the number of parts of an object downloaded
+	// concurrently, a single connection is used when not more than 1.
+	DownloadConcurrency int
+
+	// DownloadPartSize is the size of the ranges downloaded concurrently,
+	// DefaultPartSize is used when 0.
+	DownloadPartSize int64
+
+	// UploadConcurrency is the number of parts of an object uploaded
+	// concurrently when its size is known.
+	UploadConcurrency int
+
+	// UploadPartSize is the size of the parts an object is uploaded in,
+	// DefaultPartSize is used when 0.
+	UploadPartSize int64
+
+	// UploadSpool writes objects to a temporary file before uploading so
+	// their size is known and parts can be uploaded concurrently.
+	UploadSpool bool
+
+	// Retries is the number of times a failed request is retried. Transfers
+	// continue from the last part or byte received.
+	Retries int
+
+	// ConnectTimeout limits establishing a connection.
+	ConnectTimeout time.Duration
+
+	// RequestTimeout limits requests that do not transfer an object such
+	// as stat and delete, and each page of a listing.
+	RequestTimeout time.Duration
+
+	// IdleTimeout limits the time a transfer can go without receiving or
+	// sending any data.
+	IdleTimeout time.Duration
+
+	// TotalTimeout limits the time to transfer an object including retries.
+	TotalTimeout time.Duration
+
+	// Encryption is the server side encryption of objects, either sse-s3,
+	// sse-kms or sse-c. Objects are not encrypted when empty.
+	Encryption string
+
+	// KMSKeyID is the key used with sse-kms, the bucket key is used when
+	// empty.
+	KMSKeyID string
+
+	// KMSContext is the encryption context used with sse-kms.
+	KMSContext map[string]string
+
+	// CustomerKey is the 256 bit key used with sse-c. It is also required
+	// to read the objects back.
+	CustomerKey []byte
+
+	// Checksum records the SHA-256 of uploaded objects in their metadata
+	// and verifies it before a download is written to its destination.
+	Checksum bool
+
+	// SigningKey signs the checksum of uploaded objects.
+	SigningKey ed25519.PrivateKey
+
+	// VerifyKey only allows downloading objects whose signature verifies
+	// with the key.
+	VerifyKey ed25519.PublicKey
+
+	// StorageClass is the storage class of uploaded objects, the bucket
+	// default is used when empty.
+	StorageClass string
+
+	// Tags are added to uploaded objects.
+	Tags map[string]string
+
+	// Metadata is added to uploaded objects as user metadata.
+	Metadata map[string]string
+}
+
+// Storage extends storage.Storage with the S3 operations the plugin needs.
+type Storage interface {
+	storage.Storage
+
+	// Stat returns the information for the object at the path. The error
+	// wraps os.ErrNotExist when there is no such object.
+	Stat(p string) (FileInfo, error)
+
+	// PutWithOptions uploads the object to the path using the options.
+	PutWithOptions(p string, src io.Reader, opts PutOptions) error
+}
+
+// PutOptions contains options for uploading an object.
+type PutOptions struct {
+	// ContentType is the content type of the object, S3 uses
+	// application/octet-stream when empty.
+	ContentType string
+}
+
+// FileInfo describes a stored object.
+type FileInfo struct {
+	storage.FileEntry
+
+	ContentType string
 }
 
 type s3Storage struct {
 	client *minio.Client
 	opts   *Options
+	sse    encrypt.ServerSide
 	ctx    context.Context
 }
 
 // New method creates an implementation of Storage with S3 as the backend.
-func New(opts *Options) (storage.Storage, error) {
+func New(opts *Options) (Storage, error) {
 	var creds *credentials.Credentials
 	if len(opts.Access) != 0 && len(opts.Secret) != 0 {
 		creds = credentials.NewStaticV4(opts.Access, opts.Secret, opts.Token)
@@ -59,10 +165,29 @@ func New(opts *Options) (storage.Storage, error) {
 			return nil, fmt.Errorf("could not connect to %s using IAM role: %w", opts.Endpoint, err)
 		}
 	}
+	sse, err := serverSide(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	transport, err := minio.DefaultTransport(opts.UseSSL)
+	if err != nil {
+		return nil, fmt.Errorf("could not create transport: %w", err)
+	}
+	if opts.ConnectTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   opts.ConnectTimeout,
+			KeepAlive: 15 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+		transport.TLSHandshakeTimeout = opts.ConnectTimeout
+	}
+
 	client, err := minio.New(opts.Endpoint, &minio.Options{
-		Creds:  creds,
-		Secure: opts.UseSSL,
-		Region: opts.Region,
+		Creds:     creds,
+		Secure:    opts.UseSSL,
+		Region:    opts.Region,
+		Transport: attemptTransport{transport},
 	})
 
 	if err != nil {
@@ -76,6 +201,7 @@ func New(opts *Options) (storage.Storage, error) {
 	return &s3Storage{
 		client: client,
 		opts:   opts,
+		sse:    sse,
 		ctx:    context.Background(),
 	}, nil
 }
@@ -92,19 +218,17 @@ func (s *s3Storage) Get(p string, dst io.Writer) error {
 		"key":    key,
 	}).Info("downloading file")
 
-	exists, err := s.client.BucketExists(s.ctx, bucket)
+	ctx, cancel := s.transferContext()
+	defer cancel()
+
+	exists, err := s.bucketExists(ctx, bucket)
 	if err != nil {
 		return fmt.Errorf("error when accessing bucket %s: %w", bucket, err)
 	} else if !exists {
 		return fmt.Errorf("bucket %s does not exist", bucket)
 	}
 
-	object, err := s.client.GetObject(s.ctx, bucket, key, minio.GetObjectOptions{})
-	if err != nil {
-		return fmt.Errorf("could not retrieve %s from %s: %w", bucket, key, err)
-	}
-
-	numBytes, err := io.Copy(dst, object)
+	numBytes, err := s.get(ctx, bucket, key, dst)
 	if err != nil {
 		return err
 	}
@@ -118,6 +242,10 @@ func (s *s3Storage) Get(p string, dst io.Writer) error {
 }
 
 func (s *s3Storage) Put(p string, src io.Reader) error {
+	return s.PutWithOptions(p, src, PutOptions{})
+}
+
+func (s *s3Storage) PutWithOptions(p string, src io.Reader, opts PutOptions) error {
 	bucket, key := splitBucket(p)
 
 	if len(bucket) == 0 || len(key) == 0 {
@@ -129,7 +257,10 @@ func (s *s3Storage) Put(p string, src io.Reader) error {
 		"key":    key,
 	}).Info("uploading file")
 
-	exists, err := s.client.BucketExists(s.ctx, bucket)
+	ctx, cancel := s.transferContext()
+	defer cancel()
+
+	exists, err := s.bucketExists(ctx, bucket)
 	if err != nil {
 		return fmt.Errorf("error when accessing bucket %s: %w", bucket, err)
 	} else if !exists {
@@ -137,7 +268,7 @@ func (s *s3Storage) Put(p string, src io.Reader) error {
 	}
 
 	if !exists {
-		if err = s.client.MakeBucket(s.ctx, bucket, minio.MakeBucketOptions{Region: s.opts.Region}); err != nil {
+		if err = s.client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{Region: s.opts.Region}); err != nil {
 			return fmt.Errorf("could not create bucket %s: %w", bucket, err)
 		}
 		logrus.WithField("name", bucket).Info("bucket created")
@@ -145,7 +276,7 @@ func (s *s3Storage) Put(p string, src io.Reader) error {
 		logrus.WithField("name", bucket).Info("bucket found")
 	}
 
-	uploadInfo, err := s.client.PutObject(s.ctx, bucket, key, src, -1, minio.PutObjectOptions{ContentType: "application/tar"})
+	size, err := s.putObject(ctx, bucket, key, src, opts)
 	if err != nil {
 		return fmt.Errorf("could not put file in bucket %s at %s: %w", bucket, key, err)
 	}
@@ -153,11 +284,47 @@ func (s *s3Storage) Put(p string, src io.Reader) error {
 	logrus.WithFields(logrus.Fields{
 		"bucket": bucket,
 		"key":    key,
-		"size":   uploadInfo,
+		"size":   humanize.Bytes(uint64(size)),
 	}).Info("file uploaded")
 	return nil
 }
 
+func (s *s3Storage) Stat(p string) (FileInfo, error) {
+	bucket, key := splitBucket(p)
+
+	if len(bucket) == 0 || len(key) == 0 {
+		return FileInfo{}, fmt.Errorf("invalid path %s", p)
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"bucket": bucket,
+		"key":    key,
+	})
+	log.Debug("checking object")
+
+	var info minio.ObjectInfo
+	err := s.request(s.ctx, log, func(ctx context.Context) error {
+		var err error
+		info, err = s.client.StatObject(ctx, bucket, key, minio.StatObjectOptions{ServerSideEncryption: s.sse})
+		return err
+	})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return FileInfo{}, fmt.Errorf("%s does not exist in bucket %s: %w", key, bucket, os.ErrNotExist)
+		}
+		return FileInfo{}, fmt.Errorf("could not stat %s in bucket %s: %w", key, bucket, err)
+	}
+
+	return FileInfo{
+		FileEntry: storage.FileEntry{
+			Path:         bucket + "/" + info.Key,
+			Size:         info.Size,
+			LastModified: info.LastModified,
+		},
+		ContentType: info.ContentType,
+	}, nil
+}
+
 func (s *s3Storage) List(p string) ([]storage.FileEntry, error) {
 	bucket, key := splitBucket(p)
 
@@ -170,7 +337,7 @@ func (s *s3Storage) List(p string) ([]storage.FileEntry, error) {
 		"key":    key,
 	}).Info("finding objects")
 
-	exists, err := s.client.BucketExists(s.ctx, bucket)
+	exists, err := s.bucketExists(s.ctx, bucket)
 	if err != nil {
 		return nil, fmt.Errorf("error when accessing bucket %s: %w", bucket, err)
 	} else if !exists {
@@ -183,23 +350,40 @@ func (s *s3Storage) List(p string) ([]storage.FileEntry, error) {
 		Prefix:    key,
 	}
 
-	for object := range s.client.ListObjects(s.ctx, bucket, opts) {
-		if object.Err != nil {
-			return nil, fmt.Errorf("could not get file in bucket %s at %s: %w", bucket, object.Key, object.Err)
-		}
-
-		path := bucket + "/" + object.Key
-		objects = append(objects, storage.FileEntry{
-			Path:         path,
-			Size:         object.Size,
-			LastModified: object.LastModified,
+	// Listing a large prefix takes many requests so the request timeout
+	// limits each page rather than the whole listing, which is limited by
+	// the total timeout. A retry continues after the last object found.
+	ctx, cancel := s.transferContext()
+	defer cancel()
+
+	err = retry(ctx, s.opts.Retries, 0, logrus.WithField("bucket", bucket), func(ctx context.Context) error {
+		return watchIdle(ctx, s.opts.RequestTimeout, func(ctx context.Context, touch func()) error {
+			for object := range s.client.ListObjects(ctx, bucket, opts) {
+				if object.Err != nil {
+					return fmt.Errorf("could not get file in bucket %s at %s: %w", bucket, object.Key, object.Err)
+				}
+				touch()
+
+				path := bucket + "/" + object.Key
+				objects = append(objects, storage.FileEntry{
+					Path:         path,
+					Size:         object.Size,
+					LastModified: object.LastModified,
+				})
+				opts.StartAfter = object.Key
+				logrus.WithFields(logrus.Fields{
+					"bucket":        bucket,
+					"key":           object.Key,
+					"size":          humanize.Bytes(uint64(object.Size)),
+					"last-modified": object.LastModified,
+				}).Debug("found object")
+			}
+			// The listing stops without an error when cancelled
+			return ctx.Err()
 		})
-		logrus.WithFields(logrus.Fields{
-			"bucket":        bucket,
-			"key":           object.Key,
-			"size":          humanize.Bytes(uint64(object.Size)),
-			"last-modified": object.LastModified,
-		}).Debug("found object")
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	logrus.WithFields(logrus.Fields{
@@ -217,25 +401,100 @@ func (s *s3Storage) Delete(p string) error {
 		return fmt.Errorf("invalid path %s", p)
 	}
 
-	logrus.WithFields(logrus.Fields{
+	log := logrus.WithFields(logrus.Fields{
 		"bucket": bucket,
 		"key":    key,
-	}).Info("deleting object")
+	})
+	log.Info("deleting object")
 
-	exists, err := s.client.BucketExists(s.ctx, bucket)
+	exists, err := s.bucketExists(s.ctx, bucket)
 	if err != nil {
 		return fmt.Errorf("error when accessing bucket %s: %w", bucket, err)
 	} else if !exists {
 		return fmt.Errorf("bucket %s does not exist", bucket)
 	}
 
-	err = s.client.RemoveObject(s.ctx, bucket, key, minio.RemoveObjectOptions{})
+	err = s.request(s.ctx, log, func(ctx context.Context) error {
+		return s.client.RemoveObject(ctx, bucket, key, minio.RemoveObjectOptions{})
+	})
 	if err != nil {
 		return fmt.Errorf("could not delete file in %s at %s: %w", bucket, key, err)
 	}
 	return err
 }
 
+// get downloads the object verifying its checksum when enabled. Objects
+// without a checksum are downloaded without verification.
+func (s *s3Storage) get(ctx context.Context, bucket, key string, dst io.Writer) (int64, error) {
+	if !s.opts.Checksum && s.opts.VerifyKey == nil {
+		return s.getObject(ctx, bucket, key, dst)
+	}
+
+	log := logrus.WithFields(logrus.Fields{
+		"bucket": bucket,
+		"key":    key,
+	})
+
+	var info minio.ObjectInfo
+	err := s.request(ctx, log, func(ctx context.Context) error {
+		var err error
+		info, err = s.client.StatObject(ctx, bucket, key, minio.StatObjectOptions{ServerSideEncryption: s.sse})
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("could not stat %s in bucket %s: %w", key, bucket, err)
+	}
+
+	if s.opts.VerifyKey != nil {
+		if err := verify(s.opts.VerifyKey, bucket+"/"+key, info.UserMetadata); err != nil {
+			return 0, err
+		}
+		log.Debug("signature verified")
+	}
+
+	sum := checksum(info.UserMetadata)
+	if sum == "" {
+		log.Warn("object has no checksum, downloading without verification")
+		return s.getObject(ctx, bucket, key, dst)
+	}
+
+	size, err := getVerified(dst, sum, func(w io.Writer) (int64, error) {
+		return s.getObject(ctx, bucket, key, w)
+	})
+	if err != nil {
+		return size, err
+	}
+
+	log.WithField("sha256", sum).Debug("checksum verified")
+	return size, nil
+}
+
+// bucketExists checks whether the bucket exists.
+func (s *s3Storage) bucketExists(ctx context.Context, bucket string) (bool, error) {
+	var exists bool
+	err := s.request(ctx, logrus.WithField("bucket", bucket), func(ctx context.Context) error {
+		var err error
+		exists, err = s.client.BucketExists(ctx, bucket)
+		return err
+	})
+	return exists, err
+}
+
+// request calls fn retrying failures with each attempt limited to the
+// request timeout.
+func (s *s3Storage) request(ctx context.Context, log *logrus.Entry, fn func(ctx context.Context) error) error {
+	return retry(ctx, s.opts.Retries, s.opts.RequestTimeout, log, fn)
+}
+
+// transferContext returns a context for transferring an object limited to
+// the total timeout.
+func (s *s3Storage) transferContext() (context.Context, context.CancelFunc) {
+	if s.opts.TotalTimeout > 0 {
+		return context.WithTimeout(s.ctx, s.opts.TotalTimeout)
+	}
+	return context.WithCancel(s.ctx)
+}
+
 func splitBucket(p string) (string, string) {
 	// Remove initial forward slash
 	full := strings.TrimPrefix(p, "/")
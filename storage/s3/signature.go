@@ -0,0 +1,50 @@
+package s3
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+)
+
+// signatureKey is the user metadata key holding the signature of an object.
+const signatureKey = "signature"
+
+var (
+	// ErrUnsigned is returned when verifying an object that was not signed.
+	ErrUnsigned = errors.New("object is not signed")
+
+	// ErrBadSignature is returned when the signature of an object does not
+	// verify.
+	ErrBadSignature = errors.New("object signature does not verify")
+)
+
+// signedMessage returns the message signed for an object. It covers the
+// path so a signed object cannot be copied to another key.
+func signedMessage(path, sum string) []byte {
+	return []byte("drone-cache:" + path + ":" + sum)
+}
+
+// sign returns the signature for the object at path with the checksum.
+func sign(key ed25519.PrivateKey, path, sum string) string {
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(key, signedMessage(path, sum)))
+}
+
+// verify checks the signature recorded in the metadata of the object at
+// path was made for its checksum by the key.
+func verify(key ed25519.PublicKey, path string, metadata map[string]string) error {
+	sum := checksum(metadata)
+	encoded := metadataValue(metadata, signatureKey)
+	if sum == "" || encoded == "" {
+		return ErrUnsigned
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	if !ed25519.Verify(key, signedMessage(path, sum), signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
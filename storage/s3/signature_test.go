@@ -0,0 +1,43 @@
+package s3
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sum := "ffa8aae68c7e42a5d635eb00723712ee2848bb161a0ec6c27725814cf00dec76"
+	metadata := map[string]string{
+		"Sha256":    sum,
+		"Signature": sign(private, "bucket/foo/bar/main/archive.tar", sum),
+	}
+
+	if err := verify(public, "bucket/foo/bar/main/archive.tar", metadata); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := verify(other, "bucket/foo/bar/main/archive.tar", metadata); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("got %v, want %v for another key", err, ErrBadSignature)
+	}
+	if err := verify(public, "bucket/foo/bar/feature/archive.tar", metadata); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("got %v, want %v for another path", err, ErrBadSignature)
+	}
+
+	metadata["Sha256"] = "0" + sum[1:]
+	if err := verify(public, "bucket/foo/bar/main/archive.tar", metadata); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("got %v, want %v for another checksum", err, ErrBadSignature)
+	}
+
+	if err := verify(public, "bucket/foo/bar/main/archive.tar", map[string]string{"Sha256": sum}); !errors.Is(err, ErrUnsigned) {
+		t.Errorf("got %v, want %v", err, ErrUnsigned)
+	}
+}
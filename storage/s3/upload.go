@@ -0,0 +1,317 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/sirupsen/logrus"
+)
+
+// MinPartSize is the smallest part size S3 accepts for multipart uploads.
+const MinPartSize = 5 << 20
+
+// abortTimeout limits aborting a failed multipart upload.
+const abortTimeout = 30 * time.Second
+
+// multipartClient contains the requests of minio.Core used to upload an
+// object in parts.
+type multipartClient interface {
+	PutObject(ctx context.Context, bucket, object string, data io.Reader, size int64, md5Base64, sha256Hex string, opts minio.PutObjectOptions) (minio.UploadInfo, error)
+	NewMultipartUpload(ctx context.Context, bucket, object string, opts minio.PutObjectOptions) (string, error)
+	PutObjectPart(ctx context.Context, bucket, object, uploadID string, partID int, data io.Reader, size int64, md5Base64, sha256Hex string, sse encrypt.ServerSide) (minio.ObjectPart, error)
+	CompleteMultipartUpload(ctx context.Context, bucket, object, uploadID string, parts []minio.CompletePart, opts minio.PutObjectOptions) (string, error)
+	AbortMultipartUpload(ctx context.Context, bucket, object, uploadID string) error
+}
+
+// uploader uploads an object in parts. Each part is retried on its own so
+// an interrupted upload continues from the last completed part.
+type uploader struct {
+	ctx         context.Context
+	client      multipartClient
+	bucket      string
+	key         string
+	opts        minio.PutObjectOptions
+	partSize    int64
+	concurrency int
+	retries     int
+	timeout     time.Duration
+	idleTimeout time.Duration
+	log         *logrus.Entry
+}
+
+// putObject uploads src to the object. The object is uploaded in parts of
+// the configured size so only a part is buffered at a time. When spooling
+// the archive is first written to a temporary file so its size is known and
+// the parts can be uploaded concurrently.
+func (s *s3Storage) putObject(ctx context.Context, bucket, key string, src io.Reader, opts PutOptions) (int64, error) {
+	u := &uploader{
+		ctx:    ctx,
+		client: minio.Core{Client: s.client},
+		bucket: bucket,
+		key:    key,
+		opts: minio.PutObjectOptions{
+			ContentType:          opts.ContentType,
+			ServerSideEncryption: s.sse,
+			StorageClass:         s.opts.StorageClass,
+			UserTags:             s.opts.Tags,
+			UserMetadata:         make(map[string]string),
+		},
+		partSize:    s.opts.UploadPartSize,
+		concurrency: s.opts.UploadConcurrency,
+		retries:     s.opts.Retries,
+		timeout:     s.opts.RequestTimeout,
+		idleTimeout: s.opts.IdleTimeout,
+		log: logrus.WithFields(logrus.Fields{
+			"bucket": bucket,
+			"key":    key,
+		}),
+	}
+	if u.partSize <= 0 {
+		u.partSize = DefaultPartSize
+	}
+	if u.concurrency <= 0 {
+		u.concurrency = 1
+	}
+	for k, v := range s.opts.Metadata {
+		u.opts.UserMetadata[k] = v
+	}
+
+	// The checksum has to be known before the upload starts
+	if !s.opts.UploadSpool && !s.opts.Checksum && s.opts.SigningKey == nil {
+		return u.upload(src)
+	}
+
+	file, size, sum, err := spool(src)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name())
+	}()
+
+	if s.opts.Checksum || s.opts.SigningKey != nil {
+		u.opts.UserMetadata[checksumKey] = sum
+		u.log.WithField("sha256", sum).Debug("computed checksum")
+	}
+	if s.opts.SigningKey != nil {
+		u.opts.UserMetadata[signatureKey] = sign(s.opts.SigningKey, bucket+"/"+key, sum)
+		u.log.Debug("signed archive")
+	}
+
+	u.log.WithFields(logrus.Fields{
+		"size":        humanize.Bytes(uint64(size)),
+		"concurrency": u.concurrency,
+	}).Debug("uploading spooled archive")
+
+	return size, u.uploadFile(file, size)
+}
+
+// upload reads the object from src a part at a time uploading each part
+// before reading the next.
+func (u *uploader) upload(src io.Reader) (int64, error) {
+	buf := make([]byte, u.partSize)
+
+	n, err := io.ReadFull(src, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return int64(n), u.put(bytes.NewReader(buf[:n]), int64(n))
+	} else if err != nil {
+		return 0, err
+	}
+
+	uploadID, err := u.start()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		size  int64
+		parts []minio.CompletePart
+	)
+	for number := 1; n > 0; number++ {
+		part, err := u.putPart(uploadID, number, buf[:n])
+		if err != nil {
+			u.abort(uploadID)
+			return size, err
+		}
+		parts = append(parts, part)
+		size += int64(n)
+
+		n, err = io.ReadFull(src, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			u.abort(uploadID)
+			return size, err
+		}
+	}
+
+	return size, u.complete(uploadID, parts)
+}
+
+// uploadFile uploads the parts of the file concurrently.
+func (u *uploader) uploadFile(file io.ReaderAt, size int64) error {
+	if size <= u.partSize {
+		return u.put(io.NewSectionReader(file, 0, size), size)
+	}
+
+	uploadID, err := u.start()
+	if err != nil {
+		return err
+	}
+
+	count := int((size + u.partSize - 1) / u.partSize)
+	numbers := make(chan int, count)
+	for number := 1; number <= count; number++ {
+		numbers <- number
+	}
+	close(numbers)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		parts    []minio.CompletePart
+		firstErr error
+	)
+	for i := 0; i < u.concurrency && i < count; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			buf := make([]byte, u.partSize)
+			for number := range numbers {
+				mu.Lock()
+				failed := firstErr != nil
+				mu.Unlock()
+				if failed {
+					return
+				}
+
+				offset := int64(number-1) * u.partSize
+				n, err := file.ReadAt(buf, offset)
+				if err == io.EOF && offset+int64(n) == size {
+					err = nil
+				}
+
+				var part minio.CompletePart
+				if err == nil {
+					part, err = u.putPart(uploadID, number, buf[:n])
+				}
+
+				mu.Lock()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+				parts = append(parts, part)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		u.abort(uploadID)
+		return firstErr
+	}
+
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	return u.complete(uploadID, parts)
+}
+
+// put uploads an object small enough to fit in a single part.
+func (u *uploader) put(r io.ReadSeeker, size int64) error {
+	return retry(u.ctx, u.retries, 0, u.log, func(ctx context.Context) error {
+		return watchIdle(ctx, u.idleTimeout, func(ctx context.Context, touch func()) error {
+			if _, err := r.Seek(0, io.SeekStart); err != nil {
+				return permanentError{err}
+			}
+			_, err := u.client.PutObject(ctx, u.bucket, u.key, &progressReader{r: r, touch: touch}, size, "", "", u.opts)
+			return err
+		})
+	})
+}
+
+func (u *uploader) start() (string, error) {
+	var uploadID string
+	err := retry(u.ctx, u.retries, u.timeout, u.log, func(ctx context.Context) error {
+		var err error
+		uploadID, err = u.client.NewMultipartUpload(ctx, u.bucket, u.key, u.opts)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not start multipart upload: %w", err)
+	}
+	return uploadID, nil
+}
+
+func (u *uploader) putPart(uploadID string, number int, data []byte) (minio.CompletePart, error) {
+	var part minio.ObjectPart
+	err := retry(u.ctx, u.retries, 0, u.log.WithField("part", number), func(ctx context.Context) error {
+		return watchIdle(ctx, u.idleTimeout, func(ctx context.Context, touch func()) error {
+			var err error
+			r := &progressReader{r: bytes.NewReader(data), touch: touch}
+			part, err = u.client.PutObjectPart(ctx, u.bucket, u.key, uploadID, number, r, int64(len(data)), "", "", u.opts.ServerSideEncryption)
+			return err
+		})
+	})
+	if err != nil {
+		return minio.CompletePart{}, fmt.Errorf("could not upload part %d: %w", number, err)
+	}
+	return minio.CompletePart{PartNumber: part.PartNumber, ETag: part.ETag}, nil
+}
+
+func (u *uploader) complete(uploadID string, parts []minio.CompletePart) error {
+	// Completing a large upload can take a while so only the total timeout
+	// applies
+	err := retry(u.ctx, u.retries, 0, u.log, func(ctx context.Context) error {
+		_, err := u.client.CompleteMultipartUpload(ctx, u.bucket, u.key, uploadID, parts, u.opts)
+		return err
+	})
+	if err != nil {
+		u.abort(uploadID)
+		return fmt.Errorf("could not complete multipart upload: %w", err)
+	}
+	return nil
+}
+
+// abort discards the parts uploaded so they are not billed. The upload is
+// aborted even when the transfer timed out.
+func (u *uploader) abort(uploadID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+
+	if err := u.client.AbortMultipartUpload(ctx, u.bucket, u.key, uploadID); err != nil {
+		u.log.WithError(err).Warn("could not abort multipart upload")
+	}
+}
+
+// spool copies src to a temporary file returning the file positioned at the
+// start along with its size and SHA-256.
+func spool(src io.Reader) (*os.File, int64, string, error) {
+	file, err := os.CreateTemp("", "drone-cache-*")
+	if err != nil {
+		return nil, 0, "", fmt.Errorf("could not create spool file: %w", err)
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), src)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, 0, "", fmt.Errorf("could not spool archive: %w", err)
+	}
+
+	return file, size, hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,167 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/encrypt"
+	"github.com/sirupsen/logrus"
+)
+
+// memMultipart is an in memory multipartClient that fails the first attempt
+// to upload each of the failing parts.
+type memMultipart struct {
+	mu      sync.Mutex
+	object  []byte
+	parts   map[int][]byte
+	failing map[int]bool
+	puts    map[int]int
+	aborted bool
+}
+
+func newMemMultipart(failing ...int) *memMultipart {
+	m := &memMultipart{
+		parts:   make(map[int][]byte),
+		failing: make(map[int]bool),
+		puts:    make(map[int]int),
+	}
+	for _, number := range failing {
+		m.failing[number] = true
+	}
+	return m
+}
+
+func (m *memMultipart) PutObject(ctx context.Context, bucket, object string, data io.Reader, size int64, md5Base64, sha256Hex string, opts minio.PutObjectOptions) (minio.UploadInfo, error) {
+	b, err := io.ReadAll(data)
+	m.object = b
+	return minio.UploadInfo{Size: int64(len(b))}, err
+}
+
+func (m *memMultipart) NewMultipartUpload(ctx context.Context, bucket, object string, opts minio.PutObjectOptions) (string, error) {
+	return "upload", nil
+}
+
+func (m *memMultipart) PutObjectPart(ctx context.Context, bucket, object, uploadID string, partID int, data io.Reader, size int64, md5Base64, sha256Hex string, sse encrypt.ServerSide) (minio.ObjectPart, error) {
+	b, err := io.ReadAll(data)
+	if err != nil {
+		return minio.ObjectPart{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.puts[partID]++
+	if m.failing[partID] && m.puts[partID] == 1 {
+		return minio.ObjectPart{}, fmt.Errorf("write: %w", syscall.ECONNRESET)
+	}
+	m.parts[partID] = b
+	return minio.ObjectPart{PartNumber: partID, ETag: "etag"}, nil
+}
+
+func (m *memMultipart) CompleteMultipartUpload(ctx context.Context, bucket, object, uploadID string, parts []minio.CompletePart, opts minio.PutObjectOptions) (string, error) {
+	if !sort.SliceIsSorted(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber }) {
+		return "", errors.New("parts are not in order")
+	}
+	m.object = nil
+	for _, part := range parts {
+		m.object = append(m.object, m.parts[part.PartNumber]...)
+	}
+	return "etag", nil
+}
+
+func (m *memMultipart) AbortMultipartUpload(ctx context.Context, bucket, object, uploadID string) error {
+	m.aborted = true
+	return nil
+}
+
+func testUploader(t *testing.T, client multipartClient, retries int) *uploader {
+	setRetryDelay(t, 0)
+	return &uploader{
+		ctx:         context.Background(),
+		client:      client,
+		partSize:    64,
+		concurrency: 3,
+		retries:     retries,
+		log:         logrus.NewEntry(logrus.StandardLogger()),
+	}
+}
+
+func TestUpload(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	client := newMemMultipart(2, 5)
+	size, err := testUploader(t, client, 1).upload(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size != int64(len(data)) || !bytes.Equal(client.object, data) {
+		t.Error("uploaded object differs")
+	}
+	if client.puts[1] != 1 || client.puts[2] != 2 {
+		t.Errorf("expected only the failed part to be retried, got %v", client.puts)
+	}
+
+	client = newMemMultipart(2)
+	if _, err := testUploader(t, client, 0).upload(bytes.NewReader(data)); err == nil {
+		t.Error("expected error without retries")
+	}
+	if !client.aborted {
+		t.Error("expected failed upload to be aborted")
+	}
+
+	client = newMemMultipart()
+	if _, err := testUploader(t, client, 0).upload(strings.NewReader("testing cache")); err != nil {
+		t.Fatal(err)
+	}
+	if string(client.object) != "testing cache" {
+		t.Errorf("unexpected object %q", client.object)
+	}
+}
+
+func TestUploadFile(t *testing.T) {
+	data := make([]byte, 1000)
+	rand.Read(data)
+
+	client := newMemMultipart(3, 16)
+	if err := testUploader(t, client, 1).uploadFile(bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(client.object, data) {
+		t.Error("uploaded object differs")
+	}
+}
+
+func TestSpool(t *testing.T) {
+	file, size, sum, err := spool(strings.NewReader("testing cache"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if size != 13 {
+		t.Errorf("got size %d, want 13", size)
+	}
+	if want := "ffa8aae68c7e42a5d635eb00723712ee2848bb161a0ec6c27725814cf00dec76"; sum != want {
+		t.Errorf("got checksum %s, want %s", sum, want)
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "testing cache" {
+		t.Errorf("unexpected spooled content %q", data)
+	}
+}